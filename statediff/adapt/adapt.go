@@ -0,0 +1,68 @@
+// Copyright 2019 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+// Package adapt decouples the statediff builder from any one way of reading historical state, so
+// it can run against a full archive trie database as well as a snap-synced or aggressively pruned
+// node where old trie nodes are no longer available.
+package adapt
+
+import "github.com/ethereum/go-ethereum/common"
+
+// NodeIterator is the subset of trie.NodeIterator the statediff builder needs in order to walk
+// the leaves of a state (or storage) trie. A real trie.NodeIterator satisfies this interface
+// directly; a snapshot-backed StateTrie can satisfy it too, without needing real trie nodes.
+type NodeIterator interface {
+	// Next moves the iterator to the next node, descending into children when descend is true.
+	// It returns false when the iteration is complete.
+	Next(descend bool) bool
+	// Leaf returns true if the current node is a leaf (account or storage slot) node
+	Leaf() bool
+	// LeafKey returns the key of the leaf the iterator is positioned at
+	LeafKey() []byte
+	// LeafBlob returns the content of the leaf the iterator is positioned at
+	LeafBlob() []byte
+}
+
+// StateTrie is the minimal trie surface the statediff builder needs over an account or storage
+// trie
+type StateTrie interface {
+	NodeIterator(startKey []byte) NodeIterator
+}
+
+// DiffIterable is optionally implemented by a StateTrie that can produce a difference iterator
+// directly over another StateTrie of the same kind, skipping any subtrie whose hash is unchanged
+// rather than requiring every leaf on both sides to be walked and compared. trieWrapper
+// implements it on top of the real trie.NodeIterator; a snapshot-backed StateTrie does not, since
+// a flat snapshot layer has no subtrie hashes to skip by.
+type DiffIterable interface {
+	StateTrie
+	// DiffIterator returns an iterator over this trie's leaves (treated as the "new" side) that
+	// are absent or changed relative to old. ok is false if old isn't a trie this StateTrie knows
+	// how to diff against directly, in which case the caller must fall back to comparing leaves
+	// itself.
+	DiffIterator(old StateTrie) (it NodeIterator, ok bool)
+}
+
+// StateView abstracts away how the builder opens historical state: directly via trie nodes when
+// they're available, or via some other route (e.g. a snapshot layer) when they aren't
+type StateView interface {
+	// OpenTrie opens the account trie rooted at root
+	OpenTrie(root common.Hash) (StateTrie, error)
+	// OpenStorageTrie opens the storage trie of the account with the given address/root
+	OpenStorageTrie(addrHash, root common.Hash) (StateTrie, error)
+	// ContractCode returns the contract code stored under the given code hash
+	ContractCode(codeHash common.Hash) ([]byte, error)
+}
@@ -0,0 +1,160 @@
+// Copyright 2019 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package adapt
+
+import (
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/state/snapshot"
+	"github.com/ethereum/go-ethereum/log"
+)
+
+// SnapshotFallbackView wraps a primary StateView (normally a TrieView) and falls back to walking
+// the snapshot layer for a given root when the primary can't open the trie, which happens once
+// its historical nodes have been pruned (e.g. on a snap-synced or path-mode node). In that case
+// the builder ends up diffing two snapshot layers rather than two tries.
+type SnapshotFallbackView struct {
+	primary StateView
+	snaps   *snapshot.Tree
+}
+
+// NewSnapshotFallbackView creates a StateView that falls back to iterating snaps when primary
+// cannot open a requested trie root
+func NewSnapshotFallbackView(primary StateView, snaps *snapshot.Tree) *SnapshotFallbackView {
+	return &SnapshotFallbackView{primary: primary, snaps: snaps}
+}
+
+// OpenTrie opens the account trie rooted at root via the primary StateView, falling back to a
+// snapshot-backed StateTrie if the primary trie has been pruned
+func (sv *SnapshotFallbackView) OpenTrie(root common.Hash) (StateTrie, error) {
+	tr, err := sv.primary.OpenTrie(root)
+	if err == nil {
+		return tr, nil
+	}
+	log.Debug("Trie root unavailable, falling back to snapshot iteration", "root", root, "error", err)
+	if sv.snaps.Snapshot(root) == nil {
+		// the root isn't present as a snapshot layer either; surface the original trie error
+		return nil, err
+	}
+	return newSnapshotTrie(sv.snaps, root), nil
+}
+
+// OpenStorageTrie opens the storage trie of the account at addrHash, rooted at root, falling
+// back to the same account's snapshot storage layer if the trie has been pruned
+func (sv *SnapshotFallbackView) OpenStorageTrie(addrHash, root common.Hash) (StateTrie, error) {
+	tr, err := sv.primary.OpenStorageTrie(addrHash, root)
+	if err == nil {
+		return tr, nil
+	}
+	log.Debug("Storage trie root unavailable, falling back to snapshot iteration", "account", addrHash, "root", root, "error", err)
+	if sv.snaps.Snapshot(root) == nil {
+		// the root isn't present as a snapshot layer either; surface the original trie error
+		// rather than handing back an iterator with nothing behind it, which leavesOfWatched and
+		// buildStorageDiffs would otherwise silently read as "this account has no storage"
+		return nil, err
+	}
+	return newSnapshotStorageTrie(sv.snaps, root, addrHash), nil
+}
+
+// ContractCode defers to the primary StateView; contract code is content-addressed and isn't
+// affected by state pruning the way trie nodes are
+func (sv *SnapshotFallbackView) ContractCode(codeHash common.Hash) ([]byte, error) {
+	return sv.primary.ContractCode(codeHash)
+}
+
+// snapshotTrie adapts a snapshot account layer to the StateTrie interface
+type snapshotTrie struct {
+	snaps *snapshot.Tree
+	root  common.Hash
+}
+
+func newSnapshotTrie(snaps *snapshot.Tree, root common.Hash) *snapshotTrie {
+	return &snapshotTrie{snaps: snaps, root: root}
+}
+
+func (st *snapshotTrie) NodeIterator(startKey []byte) NodeIterator {
+	it, err := st.snaps.AccountIterator(st.root, common.BytesToHash(startKey))
+	return &snapshotAccountNodeIterator{it: it, err: err}
+}
+
+// snapshotStorageTrie adapts a single account's snapshot storage layer to the StateTrie interface
+type snapshotStorageTrie struct {
+	snaps     *snapshot.Tree
+	root      common.Hash
+	accntHash common.Hash
+}
+
+func newSnapshotStorageTrie(snaps *snapshot.Tree, root, accountHash common.Hash) *snapshotStorageTrie {
+	return &snapshotStorageTrie{snaps: snaps, root: root, accntHash: accountHash}
+}
+
+func (st *snapshotStorageTrie) NodeIterator(startKey []byte) NodeIterator {
+	it, err := st.snaps.StorageIterator(st.root, st.accntHash, common.BytesToHash(startKey))
+	return &snapshotStorageNodeIterator{it: it, err: err}
+}
+
+// snapshotAccountNodeIterator adapts a snapshot.AccountIterator, which only ever yields flat
+// account leaves, to the builder's NodeIterator interface. There's no tree structure to descend
+// into, so descend is ignored.
+type snapshotAccountNodeIterator struct {
+	it  snapshot.AccountIterator
+	err error
+}
+
+func (it *snapshotAccountNodeIterator) Next(descend bool) bool {
+	if it.err != nil || it.it == nil {
+		return false
+	}
+	return it.it.Next()
+}
+
+func (it *snapshotAccountNodeIterator) Leaf() bool {
+	return it.it != nil
+}
+
+func (it *snapshotAccountNodeIterator) LeafKey() []byte {
+	return it.it.Hash().Bytes()
+}
+
+func (it *snapshotAccountNodeIterator) LeafBlob() []byte {
+	return it.it.Account()
+}
+
+// snapshotStorageNodeIterator adapts a snapshot.StorageIterator, the storage-slot analogue of
+// snapshotAccountNodeIterator
+type snapshotStorageNodeIterator struct {
+	it  snapshot.StorageIterator
+	err error
+}
+
+func (it *snapshotStorageNodeIterator) Next(descend bool) bool {
+	if it.err != nil || it.it == nil {
+		return false
+	}
+	return it.it.Next()
+}
+
+func (it *snapshotStorageNodeIterator) Leaf() bool {
+	return it.it != nil
+}
+
+func (it *snapshotStorageNodeIterator) LeafKey() []byte {
+	return it.it.Hash().Bytes()
+}
+
+func (it *snapshotStorageNodeIterator) LeafBlob() []byte {
+	return it.it.Slot()
+}
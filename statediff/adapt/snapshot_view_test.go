@@ -0,0 +1,64 @@
+// Copyright 2019 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package adapt
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/state/snapshot"
+)
+
+// erroringView is a StateView whose Open* methods always fail, standing in for a primary
+// TrieView whose trie nodes have been pruned
+type erroringView struct {
+	err error
+}
+
+func (v *erroringView) OpenTrie(root common.Hash) (StateTrie, error) { return nil, v.err }
+func (v *erroringView) OpenStorageTrie(addrHash, root common.Hash) (StateTrie, error) {
+	return nil, v.err
+}
+func (v *erroringView) ContractCode(codeHash common.Hash) ([]byte, error) { return nil, v.err }
+
+// TestOpenStorageTrieSurfacesOriginalErrorWhenNoSnapshotExists checks that OpenStorageTrie, like
+// OpenTrie, reports the primary view's error rather than silently handing back a
+// snapshotStorageTrie when the snapshot layer doesn't have the requested root either - the bug
+// that let leavesOfWatched/buildStorageDiffs mistake a genuinely-unavailable storage trie for one
+// with zero slots.
+func TestOpenStorageTrieSurfacesOriginalErrorWhenNoSnapshotExists(t *testing.T) {
+	primaryErr := errors.New("missing trie node")
+	sv := NewSnapshotFallbackView(&erroringView{err: primaryErr}, new(snapshot.Tree))
+
+	_, err := sv.OpenStorageTrie(common.Hash{1}, common.Hash{2})
+	if !errors.Is(err, primaryErr) {
+		t.Fatalf("expected the primary view's error to be surfaced, got %v", err)
+	}
+}
+
+// TestOpenTrieSurfacesOriginalErrorWhenNoSnapshotExists is the account-trie analogue, covering the
+// behavior OpenStorageTrie was missing
+func TestOpenTrieSurfacesOriginalErrorWhenNoSnapshotExists(t *testing.T) {
+	primaryErr := errors.New("missing trie node")
+	sv := NewSnapshotFallbackView(&erroringView{err: primaryErr}, new(snapshot.Tree))
+
+	_, err := sv.OpenTrie(common.Hash{1})
+	if !errors.Is(err, primaryErr) {
+		t.Fatalf("expected the primary view's error to be surfaced, got %v", err)
+	}
+}
@@ -0,0 +1,80 @@
+// Copyright 2019 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package adapt
+
+import (
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/state"
+	"github.com/ethereum/go-ethereum/trie"
+)
+
+// TrieView is the default StateView, backed directly by a state.Database. It is the fast path:
+// opening a trie only succeeds if all of its nodes are still present in the database.
+type TrieView struct {
+	db state.Database
+}
+
+// NewTrieView creates a StateView backed directly by the given state.Database
+func NewTrieView(db state.Database) *TrieView {
+	return &TrieView{db: db}
+}
+
+// OpenTrie opens the account trie rooted at root. It returns an error (typically a missing trie
+// node error) if the trie has been pruned.
+func (tv *TrieView) OpenTrie(root common.Hash) (StateTrie, error) {
+	tr, err := tv.db.OpenTrie(root)
+	if err != nil {
+		return nil, err
+	}
+	return &trieWrapper{tr}, nil
+}
+
+// OpenStorageTrie opens the storage trie of the account at addrHash, rooted at root
+func (tv *TrieView) OpenStorageTrie(addrHash, root common.Hash) (StateTrie, error) {
+	tr, err := tv.db.OpenStorageTrie(addrHash, root)
+	if err != nil {
+		return nil, err
+	}
+	return &trieWrapper{tr}, nil
+}
+
+// ContractCode returns the contract code for the given code hash
+func (tv *TrieView) ContractCode(codeHash common.Hash) ([]byte, error) {
+	return tv.db.ContractCode(common.Hash{}, codeHash)
+}
+
+// trieWrapper narrows a state.Trie down to just the NodeIterator method StateTrie requires
+type trieWrapper struct {
+	trie state.Trie
+}
+
+func (w *trieWrapper) NodeIterator(startKey []byte) NodeIterator {
+	return w.trie.NodeIterator(startKey)
+}
+
+// DiffIterator returns an iterator over w's leaves that differ from old, built on top of
+// trie.NewDifferenceIterator so that subtries whose root hash is unchanged between old and w are
+// skipped entirely instead of walked. ok is false when old isn't also a *trieWrapper, in which
+// case there's no real trie on the other side to compare node hashes against.
+func (w *trieWrapper) DiffIterator(old StateTrie) (NodeIterator, bool) {
+	oldWrapper, ok := old.(*trieWrapper)
+	if !ok {
+		return nil, false
+	}
+	it, _ := trie.NewDifferenceIterator(oldWrapper.trie.NodeIterator(nil), w.trie.NodeIterator(nil))
+	return it, true
+}
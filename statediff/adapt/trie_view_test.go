@@ -0,0 +1,110 @@
+// Copyright 2019 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package adapt
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/rawdb"
+	"github.com/ethereum/go-ethereum/core/state"
+)
+
+// commitTrie writes key/value into a trie rooted at parent and commits it to db, returning the
+// new root
+func commitTrie(t *testing.T, db state.Database, parent common.Hash, key, value []byte) common.Hash {
+	t.Helper()
+	tr, err := db.OpenTrie(parent)
+	if err != nil {
+		t.Fatalf("opening trie at %s: %v", parent, err)
+	}
+	if err := tr.TryUpdate(key, value); err != nil {
+		t.Fatalf("updating trie: %v", err)
+	}
+	root, err := tr.Commit(nil)
+	if err != nil {
+		t.Fatalf("committing trie: %v", err)
+	}
+	if err := db.TrieDB().Commit(root, false, nil); err != nil {
+		t.Fatalf("committing trie db: %v", err)
+	}
+	return root
+}
+
+// TestTrieViewOpenTrieWalksRealLeaves checks that TrieView.OpenTrie, against a real
+// state.Database, returns a StateTrie whose NodeIterator actually walks the leaves written to it,
+// rather than only ever being exercised against the hand-rolled fakes in builder_test.go.
+func TestTrieViewOpenTrieWalksRealLeaves(t *testing.T) {
+	db := state.NewDatabase(rawdb.NewMemoryDatabase())
+	root := commitTrie(t, db, common.Hash{}, []byte("01234567890123456789012345678901"), []byte("value1"))
+
+	view := NewTrieView(db)
+	tr, err := view.OpenTrie(root)
+	if err != nil {
+		t.Fatalf("OpenTrie: %v", err)
+	}
+
+	var found bool
+	it := tr.NodeIterator(nil)
+	for it.Next(true) {
+		if it.Leaf() && bytes.Equal(it.LeafBlob(), []byte("value1")) {
+			found = true
+		}
+	}
+	if !found {
+		t.Fatal("expected NodeIterator to walk to the committed leaf")
+	}
+}
+
+// TestTrieWrapperDiffIteratorSkipsUnchangedSubtries checks that trieWrapper.DiffIterator, backed
+// by a real trie.NewDifferenceIterator, reports the newly-added leaf and nothing else when diffing
+// two real trie roots that share a common parent.
+func TestTrieWrapperDiffIteratorSkipsUnchangedSubtries(t *testing.T) {
+	db := state.NewDatabase(rawdb.NewMemoryDatabase())
+	oldRoot := commitTrie(t, db, common.Hash{}, []byte("01234567890123456789012345678901"), []byte("value1"))
+	newRoot := commitTrie(t, db, oldRoot, []byte("11234567890123456789012345678901"), []byte("value2"))
+
+	view := NewTrieView(db)
+	oldTrie, err := view.OpenTrie(oldRoot)
+	if err != nil {
+		t.Fatalf("OpenTrie(old): %v", err)
+	}
+	newTrie, err := view.OpenTrie(newRoot)
+	if err != nil {
+		t.Fatalf("OpenTrie(new): %v", err)
+	}
+
+	diffable, ok := newTrie.(DiffIterable)
+	if !ok {
+		t.Fatal("expected TrieView's StateTrie to implement DiffIterable")
+	}
+	it, ok := diffable.DiffIterator(oldTrie)
+	if !ok {
+		t.Fatal("expected DiffIterator to succeed diffing two real tries")
+	}
+
+	var leaves [][]byte
+	for it.Next(true) {
+		if it.Leaf() {
+			leaves = append(leaves, it.LeafBlob())
+		}
+	}
+	if len(leaves) != 1 || !bytes.Equal(leaves[0], []byte("value2")) {
+		t.Fatalf("expected exactly the one new leaf to be reported, got %v", leaves)
+	}
+}
@@ -0,0 +1,156 @@
+// Copyright 2019 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package statediff
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/log"
+	"github.com/ethereum/go-ethereum/rpc"
+)
+
+const (
+	// APIName is the namespace used for the state diffing service API
+	APIName = "statediff"
+	// APIVersion is the version of the state diffing service API
+	APIVersion = "0.0.1"
+)
+
+// PublicStateDiffAPI exposes the state diffing service over RPC
+type PublicStateDiffAPI struct {
+	sds IService
+}
+
+// NewPublicStateDiffAPI creates an rpc subscription interface over the state diffing service
+func NewPublicStateDiffAPI(sds IService) *PublicStateDiffAPI {
+	return &PublicStateDiffAPI{
+		sds: sds,
+	}
+}
+
+// Stream is the public method to setup a subscription that fires off state-diff payloads as they
+// are processed. params controls what the resulting payloads contain (block/receipts/state) and
+// which accounts and storage slots are watched; subscribers with identical params share a build
+// pass with one another. resumeFrom should be 0 on a fresh subscription, or the highest block
+// number the caller already received from a prior connection to this same logical subscription;
+// since every call gets a brand-new rpc.ID, the service has no identity to resume on its own, so
+// the caller must pass its own high-water mark back in to have the gap backfilled.
+func (api *PublicStateDiffAPI) Stream(ctx context.Context, params Params, resumeFrom uint64) (*rpc.Subscription, error) {
+	notifier, supported := rpc.NotifierFromContext(ctx)
+	if !supported {
+		return &rpc.Subscription{}, rpc.ErrNotificationsUnsupported
+	}
+
+	rpcSub := notifier.CreateSubscription()
+
+	go func() {
+		payloadChannel := make(chan Payload)
+		quitChan := make(chan bool)
+		api.sds.Subscribe(rpcSub.ID, params, payloadChannel, quitChan, resumeFrom)
+		for {
+			select {
+			case packet := <-payloadChannel:
+				if err := notifier.Notify(rpcSub.ID, packet); err != nil {
+					log.Error(fmt.Sprintf("Failed to notify subscription %s of new state diff payload; error: ", rpcSub.ID) + err.Error())
+				}
+			case <-rpcSub.Err():
+				if err := api.sds.Unsubscribe(rpcSub.ID); err != nil {
+					log.Error(fmt.Sprintf("Failed to unsubscribe %s from the state diff service; error: ", rpcSub.ID) + err.Error())
+				}
+				return
+			case <-notifier.Closed():
+				if err := api.sds.Unsubscribe(rpcSub.ID); err != nil {
+					log.Error(fmt.Sprintf("Failed to unsubscribe %s from the state diff service; error: ", rpcSub.ID) + err.Error())
+				}
+				return
+			}
+		}
+	}()
+
+	return rpcSub, nil
+}
+
+// WatchAddresses adds the given addresses to the service's persisted watch list
+func (api *PublicStateDiffAPI) WatchAddresses(addresses []common.Address) error {
+	return api.sds.WatchAddresses(addresses)
+}
+
+// UnwatchAddresses removes the given addresses from the service's persisted watch list
+func (api *PublicStateDiffAPI) UnwatchAddresses(addresses []common.Address) error {
+	return api.sds.UnwatchAddresses(addresses)
+}
+
+// SetWatchedAddresses replaces the service's persisted watch list wholesale
+func (api *PublicStateDiffAPI) SetWatchedAddresses(addresses []common.Address) error {
+	return api.sds.SetWatchedAddresses(addresses)
+}
+
+// ClearWatchedAddresses empties the service's persisted watch list
+func (api *PublicStateDiffAPI) ClearWatchedAddresses() error {
+	return api.sds.ClearWatchedAddresses()
+}
+
+// Metrics returns a point-in-time snapshot of the statediff service's internal processing
+// metrics: blocks processed, dropped subscribers, worker-pool queue depth, and mean build latency
+func (api *PublicStateDiffAPI) Metrics() MetricsSnapshot {
+	return currentMetrics()
+}
+
+// StreamStateDiffs subscribes to the state diffs for a fixed, historical range of blocks
+// [startBlock, endBlock], built via the BackFillService rather than the live chain event loop.
+// Unlike Stream, notifications stop once the whole range has been delivered (or building it
+// fails); the subscription itself stays open until the client unsubscribes.
+func (api *PublicStateDiffAPI) StreamStateDiffs(ctx context.Context, startBlock, endBlock uint64, params Params) (*rpc.Subscription, error) {
+	notifier, supported := rpc.NotifierFromContext(ctx)
+	if !supported {
+		return &rpc.Subscription{}, rpc.ErrNotificationsUnsupported
+	}
+
+	rpcSub := notifier.CreateSubscription()
+
+	go func() {
+		payloadChannel := make(chan Payload)
+		quitChan := make(chan bool)
+		go func() {
+			defer close(payloadChannel)
+			if err := api.sds.StreamRange(startBlock, endBlock, params, payloadChannel, quitChan); err != nil {
+				log.Error(fmt.Sprintf("Error streaming historical state diffs [%d, %d] to subscription %s; error: ", startBlock, endBlock, rpcSub.ID) + err.Error())
+			}
+		}()
+		for {
+			select {
+			case packet, open := <-payloadChannel:
+				if !open {
+					return
+				}
+				if err := notifier.Notify(rpcSub.ID, packet); err != nil {
+					log.Error(fmt.Sprintf("Failed to notify subscription %s of historical state diff payload; error: ", rpcSub.ID) + err.Error())
+				}
+			case <-rpcSub.Err():
+				close(quitChan)
+				return
+			case <-notifier.Closed():
+				close(quitChan)
+				return
+			}
+		}
+	}()
+
+	return rpcSub, nil
+}
@@ -0,0 +1,175 @@
+// Copyright 2019 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package statediff
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/ethereum/go-ethereum/log"
+	"github.com/ethereum/go-ethereum/rlp"
+)
+
+// BackFillConfig holds the parameters used to configure a BackFillService
+type BackFillConfig struct {
+	// Number of concurrent workers used to build historical state diffs
+	Workers uint
+	// Number of blocks handed to a single worker at a time
+	BatchSize uint64
+}
+
+// DefaultBackFillConfig is used when a BackFillConfig is not otherwise provided
+var DefaultBackFillConfig = BackFillConfig{
+	Workers:   4,
+	BatchSize: 100,
+}
+
+// BackFillService walks an arbitrary range of historical blocks and builds their state diffs,
+// independent of the live statediff.Service.Loop chain event stream. It is used both to serve
+// StreamStateDiffs RPC requests for a fixed range and to backfill gaps a subscriber missed while
+// disconnected.
+type BackFillService struct {
+	// Used to build the historical state diff objects
+	Builder StateDiffBuilder
+	// Used to look up historical blocks by number/hash
+	BlockChain blockChain
+	// Concurrency and batching knobs
+	Config BackFillConfig
+}
+
+// NewBackFillService creates a new BackFillService
+func NewBackFillService(blockChain blockChain, builder StateDiffBuilder, config BackFillConfig) *BackFillService {
+	if config.Workers == 0 {
+		config.Workers = DefaultBackFillConfig.Workers
+	}
+	if config.BatchSize == 0 {
+		config.BatchSize = DefaultBackFillConfig.BatchSize
+	}
+	return &BackFillService{
+		Builder:    builder,
+		BlockChain: blockChain,
+		Config:     config,
+	}
+}
+
+// BackFill builds the state diffs for every block in [startBlock, endBlock] and emits them on
+// sink. Blocks are farmed out across a pool of bfs.Config.Workers goroutines in batches of
+// bfs.Config.BatchSize, so the range is not necessarily delivered in ascending order; callers
+// that need ordering (e.g. a live subscriber catching up) should buffer and re-sort by
+// Payload's wrapped StateDiff.BlockNumber themselves. BackFill returns once the whole range has
+// been processed, or, once quitChan is closed, as soon as every worker has finished the block it
+// is currently building.
+func (bfs *BackFillService) BackFill(startBlock, endBlock uint64, params Params, sink chan<- Payload, quitChan <-chan bool) error {
+	if endBlock < startBlock {
+		return fmt.Errorf("backfill end block %d is before start block %d", endBlock, startBlock)
+	}
+	log.Info("Starting statediff backfill", "start", startBlock, "end", endBlock, "workers", bfs.Config.Workers)
+
+	batchCh := make(chan [2]uint64)
+	errCh := make(chan error, bfs.Config.Workers)
+	// closed once every worker has returned, so the producer below can stop trying to hand
+	// batches to a pool that has already died (e.g. every worker hit a missing-block error)
+	// instead of blocking on batchCh forever
+	workersDone := make(chan struct{})
+	var wg sync.WaitGroup
+
+	for w := uint(0); w < bfs.Config.Workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for batch := range batchCh {
+				if err := bfs.backFillRange(batch[0], batch[1], params, sink, quitChan); err != nil {
+					errCh <- err
+					return
+				}
+			}
+		}()
+	}
+	go func() {
+		wg.Wait()
+		close(workersDone)
+	}()
+
+batchLoop:
+	for batchStart := startBlock; batchStart <= endBlock; batchStart += bfs.Config.BatchSize {
+		batchEnd := batchStart + bfs.Config.BatchSize - 1
+		if batchEnd > endBlock {
+			batchEnd = endBlock
+		}
+		select {
+		case batchCh <- [2]uint64{batchStart, batchEnd}:
+		case <-quitChan:
+			break batchLoop
+		case <-workersDone:
+			break batchLoop
+		}
+	}
+	close(batchCh)
+	<-workersDone
+	close(errCh)
+
+	if err := <-errCh; err != nil {
+		return err
+	}
+	log.Info("Finished statediff backfill", "start", startBlock, "end", endBlock)
+	return nil
+}
+
+// backFillRange sequentially builds the state diffs for [start, end] and writes them to sink,
+// with the block and receipts RLP alongside when params asks for them
+func (bfs *BackFillService) backFillRange(start, end uint64, params Params, sink chan<- Payload, quitChan <-chan bool) error {
+	for blockNumber := start; blockNumber <= end; blockNumber++ {
+		select {
+		case <-quitChan:
+			return nil
+		default:
+		}
+		currentBlock := bfs.BlockChain.GetBlockByNumber(blockNumber)
+		if currentBlock == nil {
+			return fmt.Errorf("backfill could not find block %d", blockNumber)
+		}
+		parentBlock := bfs.BlockChain.GetBlockByHash(currentBlock.ParentHash())
+		if parentBlock == nil {
+			return fmt.Errorf("backfill could not find parent of block %d", blockNumber)
+		}
+		stateDiff, err := bfs.Builder.BuildStateDiff(parentBlock.Root(), currentBlock.Root(), currentBlock.Number(), currentBlock.Hash(), params)
+		if err != nil {
+			return fmt.Errorf("backfill failed to build state diff for block %d: %w", blockNumber, err)
+		}
+		stateDiffRlp, err := rlp.EncodeToBytes(stateDiff)
+		if err != nil {
+			return err
+		}
+		payload := Payload{StateDiffRlp: stateDiffRlp}
+		if params.IncludeBlock {
+			if payload.BlockRlp, err = rlp.EncodeToBytes(currentBlock); err != nil {
+				return err
+			}
+		}
+		if params.IncludeReceipts {
+			if payload.ReceiptsRlp, err = rlp.EncodeToBytes(bfs.BlockChain.GetReceiptsByHash(currentBlock.Hash())); err != nil {
+				return err
+			}
+		}
+		select {
+		case sink <- payload:
+		case <-quitChan:
+			return nil
+		}
+	}
+	return nil
+}
@@ -0,0 +1,68 @@
+// Copyright 2019 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package statediff
+
+import (
+	"testing"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core"
+	"github.com/ethereum/go-ethereum/core/state/snapshot"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/event"
+)
+
+// missingBlockChain is a blockChain whose GetBlockByNumber always reports the requested block as
+// missing, simulating a pruned/never-synced range for every backfill worker
+type missingBlockChain struct{}
+
+func (missingBlockChain) SubscribeChainEvent(ch chan<- core.ChainEvent) event.Subscription {
+	return event.NewSubscription(func(unsubscribed <-chan struct{}) error {
+		<-unsubscribed
+		return nil
+	})
+}
+func (missingBlockChain) GetBlockByHash(common.Hash) *types.Block       { return nil }
+func (missingBlockChain) GetBlockByNumber(uint64) *types.Block          { return nil }
+func (missingBlockChain) CurrentBlock() *types.Block                    { return nil }
+func (missingBlockChain) AddToStateDiffProcessedCollection(common.Hash) {}
+func (missingBlockChain) GetReceiptsByHash(common.Hash) types.Receipts  { return nil }
+func (missingBlockChain) Snapshots() *snapshot.Tree                     { return nil }
+
+// TestBackFillDoesNotDeadlockWhenAllWorkersError guards against the producer blocking on
+// batchCh forever after every worker has already exited on error (e.g. every block in the
+// requested range is missing/pruned): it must still return that error instead of hanging.
+func TestBackFillDoesNotDeadlockWhenAllWorkersError(t *testing.T) {
+	bfs := NewBackFillService(missingBlockChain{}, NewBuilder(nil), BackFillConfig{Workers: 2, BatchSize: 1})
+	sink := make(chan Payload, 1)
+	quit := make(chan bool)
+
+	done := make(chan error, 1)
+	go func() {
+		done <- bfs.BackFill(1, 100, Params{IncludeState: false}, sink, quit)
+	}()
+
+	select {
+	case err := <-done:
+		if err == nil {
+			t.Fatal("expected an error backfilling a range of entirely missing blocks")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("BackFill deadlocked instead of returning the missing-block error")
+	}
+}
@@ -0,0 +1,342 @@
+// Copyright 2019 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package statediff
+
+import (
+	"bytes"
+	"fmt"
+	"math/big"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/ethereum/go-ethereum/rlp"
+	"github.com/ethereum/go-ethereum/statediff/adapt"
+)
+
+// StateDiffBuilder is used to build a StateDiff object from two blocks' state roots. It is
+// agnostic to how the underlying state is actually read; see adapt.StateView.
+type StateDiffBuilder interface {
+	BuildStateDiff(oldStateRoot, newStateRoot common.Hash, blockNumber *big.Int, blockHash common.Hash, params Params) (StateDiff, error)
+}
+
+// builder is the sole StateDiffBuilder implementation; it is "trie-backed" or "snapshot-backed"
+// only in the sense of whichever adapt.StateView it was constructed with, since both kinds of
+// view expose the same narrow adapt.StateTrie/adapt.NodeIterator surface to diff against
+type builder struct {
+	view adapt.StateView
+}
+
+// NewBuilder is used to create a statediff builder over the given state view. Pass an
+// adapt.TrieView for a full archive node, or an adapt.SnapshotFallbackView to tolerate pruned
+// historical trie nodes by falling back to snapshot iteration.
+func NewBuilder(view adapt.StateView) StateDiffBuilder {
+	return &builder{view: view}
+}
+
+// BuildStateDiff builds a StateDiff object by comparing the leaf nodes of the old and new state.
+// When params.WatchedAddresses is non-empty, only those accounts are diffed: rather than walking
+// every leaf and discarding the rest, the builder seeks the iterator directly to each watched
+// account hash, so a handful of watched contracts stays cheap to diff even against a full trie.
+// Otherwise, when the view's tries support it (adapt.DiffIterable), the builder walks a single
+// difference iterator that skips any subtrie whose hash is unchanged, rather than materializing
+// every leaf of both the old and new trie just to throw most of them away; it only falls back to
+// that full two-sided walk when the view can't produce one (e.g. a snapshot-backed trie).
+func (sdb *builder) BuildStateDiff(oldStateRoot, newStateRoot common.Hash, blockNumber *big.Int, blockHash common.Hash, params Params) (StateDiff, error) {
+	if !params.IncludeState {
+		return StateDiff{BlockNumber: blockNumber, BlockHash: blockHash}, nil
+	}
+
+	oldTrie, err := sdb.view.OpenTrie(oldStateRoot)
+	if err != nil {
+		return StateDiff{}, err
+	}
+	newTrie, err := sdb.view.OpenTrie(newStateRoot)
+	if err != nil {
+		return StateDiff{}, err
+	}
+
+	var createdAndUpdated, deleted []AccountDiff
+	if watched := watchedAddressHashes(params.WatchedAddresses); len(watched) > 0 {
+		createdAndUpdated, deleted = diffLeaves(leavesOfWatched(oldTrie, watched), leavesOfWatched(newTrie, watched))
+	} else if fastCreatedAndUpdated, fastDeleted, ok := diffTries(oldTrie, newTrie); ok {
+		createdAndUpdated, deleted = fastCreatedAndUpdated, fastDeleted
+	} else {
+		createdAndUpdated, deleted = diffLeaves(leavesOf(oldTrie), leavesOf(newTrie))
+	}
+
+	if len(params.WatchedStorageKeys) > 0 {
+		if err := sdb.populateStorageDiffs(oldTrie, newTrie, createdAndUpdated, params.WatchedStorageKeys); err != nil {
+			return StateDiff{}, err
+		}
+	}
+
+	if params.IncludeCode {
+		if err := sdb.populateCode(createdAndUpdated); err != nil {
+			return StateDiff{}, err
+		}
+	}
+
+	return StateDiff{
+		BlockNumber:     blockNumber,
+		BlockHash:       blockHash,
+		CreatedAccounts: createdAndUpdated,
+		DeletedAccounts: deleted,
+		UpdatedAccounts: []AccountDiff{},
+	}, nil
+}
+
+// diffTries diffs oldTrie and newTrie via adapt.DiffIterable, walking only the subtries whose hash
+// changed between the two. ok is false when either trie doesn't support it, in which case the
+// caller should fall back to leavesOf and diffLeaves.
+func diffTries(oldTrie, newTrie adapt.StateTrie) (createdAndUpdated, deleted []AccountDiff, ok bool) {
+	newDiffable, ok := newTrie.(adapt.DiffIterable)
+	if !ok {
+		return nil, nil, false
+	}
+	oldDiffable, ok := oldTrie.(adapt.DiffIterable)
+	if !ok {
+		return nil, nil, false
+	}
+
+	forwardIt, ok := newDiffable.DiffIterator(oldTrie)
+	if !ok {
+		return nil, nil, false
+	}
+	changedKeys := make(map[string]struct{})
+	createdAndUpdated = make([]AccountDiff, 0)
+	for forwardIt.Next(true) {
+		if !forwardIt.Leaf() {
+			continue
+		}
+		key := string(forwardIt.LeafKey())
+		changedKeys[key] = struct{}{}
+		createdAndUpdated = append(createdAndUpdated, AccountDiff{Leaf: true, Key: []byte(key), Value: forwardIt.LeafBlob()})
+	}
+
+	// The forward diff only reports leaves on the new side, so a genuinely deleted account (one
+	// with no counterpart in newTrie at all) never shows up in it. Walk the reverse difference to
+	// find those, skipping any key the forward pass already reported as created/updated.
+	reverseIt, ok := oldDiffable.DiffIterator(newTrie)
+	if !ok {
+		return nil, nil, false
+	}
+	deleted = make([]AccountDiff, 0)
+	for reverseIt.Next(true) {
+		if !reverseIt.Leaf() {
+			continue
+		}
+		key := string(reverseIt.LeafKey())
+		if _, changed := changedKeys[key]; changed {
+			continue
+		}
+		deleted = append(deleted, AccountDiff{Leaf: true, Key: []byte(key), Value: reverseIt.LeafBlob()})
+	}
+	return createdAndUpdated, deleted, true
+}
+
+// diffLeaves compares two already-materialized leaf maps, the fallback path used when the view's
+// tries don't support adapt.DiffIterable
+func diffLeaves(oldLeaves, newLeaves map[string][]byte) (createdAndUpdated, deleted []AccountDiff) {
+	createdAndUpdated = make([]AccountDiff, 0)
+	for key, value := range newLeaves {
+		if oldValue, ok := oldLeaves[key]; !ok || !bytes.Equal(oldValue, value) {
+			createdAndUpdated = append(createdAndUpdated, AccountDiff{Leaf: true, Key: []byte(key), Value: value})
+		}
+	}
+	deleted = make([]AccountDiff, 0)
+	for key, value := range oldLeaves {
+		if _, ok := newLeaves[key]; !ok {
+			deleted = append(deleted, AccountDiff{Leaf: true, Key: []byte(key), Value: value})
+		}
+	}
+	return createdAndUpdated, deleted
+}
+
+// leavesOf walks every leaf of a trie into a key->value map
+func leavesOf(tr adapt.StateTrie) map[string][]byte {
+	leaves := make(map[string][]byte)
+	it := tr.NodeIterator(nil)
+	for it.Next(true) {
+		if !it.Leaf() {
+			continue
+		}
+		leaves[string(it.LeafKey())] = it.LeafBlob()
+	}
+	return leaves
+}
+
+// leavesOfWatched seeks the iterator directly to each watched account hash instead of walking the
+// whole trie, so diffing only touches the subtries that actually lead to a watched account
+func leavesOfWatched(tr adapt.StateTrie, watched map[common.Hash]bool) map[string][]byte {
+	leaves := make(map[string][]byte, len(watched))
+	for hash := range watched {
+		it := tr.NodeIterator(hash.Bytes())
+		for it.Next(true) {
+			if !it.Leaf() {
+				continue
+			}
+			if common.BytesToHash(it.LeafKey()) == hash {
+				leaves[string(it.LeafKey())] = it.LeafBlob()
+			}
+			break
+		}
+	}
+	return leaves
+}
+
+// watchedAddressHashes keccak256-hashes a set of watched addresses, since that's the form their
+// keys take in the account trie
+func watchedAddressHashes(addresses []common.Address) map[common.Hash]bool {
+	if len(addresses) == 0 {
+		return nil
+	}
+	hashes := make(map[common.Hash]bool, len(addresses))
+	for _, addr := range addresses {
+		hashes[crypto.Keccak256Hash(addr.Bytes())] = true
+	}
+	return hashes
+}
+
+// accountLeaf is the RLP structure of an account trie leaf, redeclared locally since the
+// equivalent type in core/state isn't exported
+type accountLeaf struct {
+	Nonce    uint64
+	Balance  *big.Int
+	Root     common.Hash
+	CodeHash []byte
+}
+
+// emptyCodeHash is the CodeHash every externally-owned account leaf carries, since it has no code
+var emptyCodeHash = crypto.Keccak256(nil)
+
+// populateCode fills in the Code field of every account in accounts that has contract code,
+// fetching it from the builder's view by the CodeHash recorded in its account leaf
+func (sdb *builder) populateCode(accounts []AccountDiff) error {
+	for i := range accounts {
+		var account accountLeaf
+		if err := rlp.DecodeBytes(accounts[i].Value, &account); err != nil {
+			return fmt.Errorf("decoding account at key %x for code: %w", accounts[i].Key, err)
+		}
+		if bytes.Equal(account.CodeHash, emptyCodeHash) {
+			continue
+		}
+		code, err := sdb.view.ContractCode(common.BytesToHash(account.CodeHash))
+		if err != nil {
+			return fmt.Errorf("fetching code for account at key %x: %w", accounts[i].Key, err)
+		}
+		accounts[i].Code = code
+	}
+	return nil
+}
+
+// populateStorageDiffs fills in the Storage field of every account in accounts that appears in
+// watchedStorage with at least one watched slot, by diffing that account's old and new storage
+// trie the same way BuildStateDiff diffs watched accounts: seeking directly to each watched slot
+// rather than walking the whole storage trie. It returns an error if such an account's new or
+// previous leaf can't be decoded.
+func (sdb *builder) populateStorageDiffs(oldTrie, newTrie adapt.StateTrie, accounts []AccountDiff, watchedStorage map[common.Address][]common.Hash) error {
+	addrByHash := make(map[common.Hash]common.Address, len(watchedStorage))
+	for addr := range watchedStorage {
+		addrByHash[crypto.Keccak256Hash(addr.Bytes())] = addr
+	}
+
+	for i := range accounts {
+		addrHash := common.BytesToHash(accounts[i].Key)
+		addr, ok := addrByHash[addrHash]
+		if !ok {
+			continue
+		}
+		keys := watchedStorage[addr]
+		if len(keys) == 0 {
+			continue
+		}
+		var newAccount accountLeaf
+		if err := rlp.DecodeBytes(accounts[i].Value, &newAccount); err != nil {
+			return fmt.Errorf("decoding account %s for storage diff: %w", addr, err)
+		}
+		oldRoot, err := previousStorageRoot(oldTrie, addrHash)
+		if err != nil {
+			return fmt.Errorf("decoding previous account %s for storage diff: %w", addr, err)
+		}
+		storageDiffs, err := sdb.buildStorageDiffs(addrHash, oldRoot, newAccount.Root, keys)
+		if err != nil {
+			return fmt.Errorf("building storage diff for account %s: %w", addr, err)
+		}
+		accounts[i].Storage = storageDiffs
+	}
+	return nil
+}
+
+// previousStorageRoot looks up addrHash's account leaf in oldTrie and decodes its storage root.
+// It returns the zero hash if the account didn't exist in oldTrie, which buildStorageDiffs treats
+// as "every watched slot is newly created".
+func previousStorageRoot(oldTrie adapt.StateTrie, addrHash common.Hash) (common.Hash, error) {
+	oldLeaves := leavesOfWatched(oldTrie, map[common.Hash]bool{addrHash: true})
+	oldValue, ok := oldLeaves[string(addrHash.Bytes())]
+	if !ok {
+		return common.Hash{}, nil
+	}
+	var oldAccount accountLeaf
+	if err := rlp.DecodeBytes(oldValue, &oldAccount); err != nil {
+		return common.Hash{}, err
+	}
+	return oldAccount.Root, nil
+}
+
+// buildStorageDiffs diffs the storage slots in keys between addrHash's old and new storage trie,
+// seeking the iterator directly to each watched slot instead of walking the whole storage trie
+func (sdb *builder) buildStorageDiffs(addrHash, oldRoot, newRoot common.Hash, keys []common.Hash) ([]StorageDiff, error) {
+	watched := watchedStorageKeyHashes(keys)
+
+	newStorageTrie, err := sdb.view.OpenStorageTrie(addrHash, newRoot)
+	if err != nil {
+		return nil, err
+	}
+	newLeaves := leavesOfWatched(newStorageTrie, watched)
+
+	var oldLeaves map[string][]byte
+	if oldRoot != (common.Hash{}) {
+		oldStorageTrie, err := sdb.view.OpenStorageTrie(addrHash, oldRoot)
+		if err != nil {
+			return nil, err
+		}
+		oldLeaves = leavesOfWatched(oldStorageTrie, watched)
+	}
+
+	diffs := make([]StorageDiff, 0, len(keys))
+	for key, value := range newLeaves {
+		if oldValue, ok := oldLeaves[key]; !ok || !bytes.Equal(oldValue, value) {
+			diffs = append(diffs, StorageDiff{Leaf: true, Key: []byte(key), Value: value})
+		}
+	}
+	for key, value := range oldLeaves {
+		if _, ok := newLeaves[key]; !ok {
+			diffs = append(diffs, StorageDiff{Leaf: true, Key: []byte(key), Value: value})
+		}
+	}
+	return diffs, nil
+}
+
+// watchedStorageKeyHashes keccak256-hashes a set of watched storage slot keys, since that's the
+// form their keys take in the storage trie
+func watchedStorageKeyHashes(keys []common.Hash) map[common.Hash]bool {
+	hashes := make(map[common.Hash]bool, len(keys))
+	for _, key := range keys {
+		hashes[crypto.Keccak256Hash(key.Bytes())] = true
+	}
+	return hashes
+}
@@ -0,0 +1,98 @@
+// Copyright 2019 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package statediff
+
+import (
+	"testing"
+
+	"github.com/ethereum/go-ethereum/statediff/adapt"
+)
+
+type fakeLeaf struct {
+	key   []byte
+	value []byte
+}
+
+// fakeIterator is a canned adapt.NodeIterator over a fixed list of leaves, used to stand in for a
+// real difference iterator in tests
+type fakeIterator struct {
+	leaves []fakeLeaf
+	idx    int
+}
+
+func (it *fakeIterator) Next(bool) bool {
+	it.idx++
+	return it.idx <= len(it.leaves)
+}
+func (it *fakeIterator) Leaf() bool       { return it.idx >= 1 && it.idx <= len(it.leaves) }
+func (it *fakeIterator) LeafKey() []byte  { return it.leaves[it.idx-1].key }
+func (it *fakeIterator) LeafBlob() []byte { return it.leaves[it.idx-1].value }
+
+// fakeDiffTrie implements adapt.DiffIterable by returning a canned set of leaves for a
+// DiffIterator call against a specific other trie, rather than actually computing one, so tests
+// can exercise diffTries' forward/reverse reconciliation without a real trie database
+type fakeDiffTrie struct {
+	diffAgainst map[adapt.StateTrie][]fakeLeaf
+}
+
+func (t *fakeDiffTrie) NodeIterator(startKey []byte) adapt.NodeIterator { return &fakeIterator{} }
+
+func (t *fakeDiffTrie) DiffIterator(old adapt.StateTrie) (adapt.NodeIterator, bool) {
+	leaves, ok := t.diffAgainst[old]
+	return &fakeIterator{leaves: leaves}, ok
+}
+
+// TestDiffTriesReconcilesForwardAndReverse checks that a key reported as changed by both the
+// forward (new-vs-old) and reverse (old-vs-new) difference iterators is reported exactly once, as
+// an update, rather than also showing up as a deletion.
+func TestDiffTriesReconcilesForwardAndReverse(t *testing.T) {
+	oldTrie := &fakeDiffTrie{diffAgainst: make(map[adapt.StateTrie][]fakeLeaf)}
+	newTrie := &fakeDiffTrie{diffAgainst: make(map[adapt.StateTrie][]fakeLeaf)}
+
+	newTrie.diffAgainst[oldTrie] = []fakeLeaf{
+		{key: []byte("created"), value: []byte("v1")},
+		{key: []byte("updated"), value: []byte("v2-new")},
+	}
+	oldTrie.diffAgainst[newTrie] = []fakeLeaf{
+		{key: []byte("updated"), value: []byte("v2-old")},
+		{key: []byte("deleted"), value: []byte("v3")},
+	}
+
+	createdAndUpdated, deleted, ok := diffTries(oldTrie, newTrie)
+	if !ok {
+		t.Fatal("expected diffTries to use the DiffIterable fast path")
+	}
+	if len(createdAndUpdated) != 2 {
+		t.Fatalf("expected 2 created/updated accounts, got %d", len(createdAndUpdated))
+	}
+	if len(deleted) != 1 || string(deleted[0].Key) != "deleted" {
+		t.Fatalf("expected only the genuinely deleted account, got %+v", deleted)
+	}
+}
+
+// TestDiffTriesFallsBackWhenNotDiffable checks that diffTries reports ok=false, rather than
+// panicking or silently returning an empty diff, when a trie doesn't implement adapt.DiffIterable
+func TestDiffTriesFallsBackWhenNotDiffable(t *testing.T) {
+	if _, _, ok := diffTries(leavesOnlyTrie{}, leavesOnlyTrie{}); ok {
+		t.Fatal("expected diffTries to report ok=false for a non-diffable StateTrie")
+	}
+}
+
+// leavesOnlyTrie implements adapt.StateTrie but not adapt.DiffIterable
+type leavesOnlyTrie struct{}
+
+func (leavesOnlyTrie) NodeIterator(startKey []byte) adapt.NodeIterator { return &fakeIterator{} }
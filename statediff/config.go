@@ -0,0 +1,41 @@
+// Copyright 2019 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package statediff
+
+import "database/sql"
+
+// Config holds the parameters used to configure the statediff.Service
+type Config struct {
+	// Whether or not to enable the state diffing service on startup
+	Enabled bool
+	// Concurrency and batching parameters for the historical backfill subsystem
+	BackFill BackFillConfig
+	// Which durable sink(s), if any, to additionally write every processed payload to
+	WriteMode WriteMode
+	// Directory a FileWriter writes into; required when WriteMode is WriteModeFile or WriteModeBoth
+	FileWriterDir string
+	// Already-opened connection pool a PostgresWriter writes through; required when WriteMode is
+	// WriteModePostgres or WriteModeBoth
+	PostgresDB *sql.DB
+	// Number of goroutines used to build state diffs concurrently; defaults to DefaultWorkers
+	Workers int
+	// Upper bound on the number of blocks that may be dispatched to the worker pool but not yet
+	// delivered (built or still awaiting their turn in the reorder buffer); defaults to
+	// DefaultMaxQueuedBlocks. Once reached, Loop stops reading new chain events until a delivery
+	// frees up room, rather than dropping events.
+	MaxQueuedBlocks int
+}
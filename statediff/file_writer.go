@@ -0,0 +1,112 @@
+// Copyright 2019 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package statediff
+
+import (
+	"encoding/csv"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/ethereum/go-ethereum/core/types"
+)
+
+// FileWriter writes each block's state diff payload out as a standalone RLP file, alongside a
+// CSV manifest (one row per block) that a downstream loader can walk to find them
+type FileWriter struct {
+	mu        sync.Mutex
+	dir       string
+	manifest  *os.File
+	csvWriter *csv.Writer
+}
+
+// NewFileWriter creates a FileWriter rooted at dir, creating dir and its manifest file if they
+// don't already exist
+func NewFileWriter(dir string) (*FileWriter, error) {
+	if dir == "" {
+		return nil, fmt.Errorf("statediff: file write mode requires a Config.FileWriterDir")
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	manifest, err := os.OpenFile(filepath.Join(dir, "manifest.csv"), os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		return nil, err
+	}
+	return &FileWriter{
+		dir:       dir,
+		manifest:  manifest,
+		csvWriter: csv.NewWriter(manifest),
+	}, nil
+}
+
+// WriteStateDiff writes the block's IPLD payload (state diff, and block/receipts RLP if present)
+// to its own file and appends a row recording it to the manifest
+func (fw *FileWriter) WriteStateDiff(block *types.Block, stateDiff StateDiff, payload Payload) error {
+	fw.mu.Lock()
+	defer fw.mu.Unlock()
+
+	name := fmt.Sprintf("%d-%s.rlp", block.NumberU64(), block.Hash().Hex())
+	path := filepath.Join(fw.dir, name)
+	if err := os.WriteFile(path, payload.StateDiffRlp, 0644); err != nil {
+		return err
+	}
+
+	blockName, err := fw.writeSidecar(block, "block", payload.BlockRlp)
+	if err != nil {
+		return err
+	}
+	receiptsName, err := fw.writeSidecar(block, "receipts", payload.ReceiptsRlp)
+	if err != nil {
+		return err
+	}
+
+	if err := fw.csvWriter.Write([]string{
+		fmt.Sprintf("%d", block.NumberU64()),
+		block.Hash().Hex(),
+		name,
+		blockName,
+		receiptsName,
+	}); err != nil {
+		return err
+	}
+	fw.csvWriter.Flush()
+	return fw.csvWriter.Error()
+}
+
+// writeSidecar writes rlp to its own file alongside the block's state diff file and returns the
+// name recorded for it in the manifest, or "" without writing anything if rlp is empty (i.e. the
+// payload's params didn't request it)
+func (fw *FileWriter) writeSidecar(block *types.Block, kind string, rlp []byte) (string, error) {
+	if len(rlp) == 0 {
+		return "", nil
+	}
+	name := fmt.Sprintf("%d-%s.%s.rlp", block.NumberU64(), block.Hash().Hex(), kind)
+	if err := os.WriteFile(filepath.Join(fw.dir, name), rlp, 0644); err != nil {
+		return "", err
+	}
+	return name, nil
+}
+
+// Close flushes and closes the manifest file
+func (fw *FileWriter) Close() error {
+	fw.mu.Lock()
+	defer fw.mu.Unlock()
+	fw.csvWriter.Flush()
+	return fw.manifest.Close()
+}
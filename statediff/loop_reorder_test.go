@@ -0,0 +1,106 @@
+// Copyright 2019 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package statediff
+
+import "testing"
+
+// TestReorderBufferDeliversReorgedReplacement exercises the real reorderBuffer type (the one Loop
+// actually drives) to check that a result for a block number the buffer has already delivered
+// past - the case a chain reorg produces, since that block's replacement is built and reported
+// only after later blocks have already been delivered - is still delivered, instead of being
+// keyed into pending under a number nothing ever looks at again.
+func TestReorderBufferDeliversReorgedReplacement(t *testing.T) {
+	buf := newReorderBuffer()
+	var delivered []uint64
+	newResult := func(n uint64) blockResult {
+		buf.dispatch(n)
+		return blockResult{blockNumber: n, deliver: func() { delivered = append(delivered, n) }}
+	}
+
+	// Blocks 0, 1, 2 arrive and are delivered in order, advancing nextToDeliver to 3.
+	buf.deliver(newResult(0))
+	buf.deliver(newResult(1))
+	buf.deliver(newResult(2))
+	if buf.nextToDeliver != 3 {
+		t.Fatalf("expected nextToDeliver to be 3, got %d", buf.nextToDeliver)
+	}
+
+	// A reorg's replacement for block 1 finishes building late, after block 1 has already been
+	// delivered under the old fork. It must still reach delivered, not vanish into pending.
+	buf.deliver(newResult(1))
+
+	want := []uint64{0, 1, 2, 1}
+	if len(delivered) != len(want) {
+		t.Fatalf("delivered = %v, want %v", delivered, want)
+	}
+	for i, n := range want {
+		if delivered[i] != n {
+			t.Fatalf("delivered = %v, want %v", delivered, want)
+		}
+	}
+	if len(buf.pending) != 0 {
+		t.Fatalf("expected no blocks left stuck in pending, got %v", buf.pending)
+	}
+	if buf.queueDepth() != 0 {
+		t.Fatalf("expected queueDepth to be 0 once everything is delivered, got %d", buf.queueDepth())
+	}
+}
+
+// TestReorderBufferQueuesOutOfOrderResults checks that a result arriving out of order is held in
+// pending until the gap in front of it is filled, then delivered in block-number order.
+func TestReorderBufferQueuesOutOfOrderResults(t *testing.T) {
+	buf := newReorderBuffer()
+	var delivered []uint64
+	newResult := func(n uint64) blockResult {
+		buf.dispatch(n)
+		return blockResult{blockNumber: n, deliver: func() { delivered = append(delivered, n) }}
+	}
+
+	block0 := newResult(0)
+	block1 := newResult(1)
+	block2 := newResult(2)
+
+	// Block 2 finishes building before block 1; it must wait in pending rather than being
+	// delivered out of order.
+	buf.deliver(block2)
+	if len(delivered) != 0 {
+		t.Fatalf("expected nothing delivered yet, got %v", delivered)
+	}
+	if buf.queueDepth() != 3 {
+		t.Fatalf("expected all 3 blocks to still be in flight, got %d", buf.queueDepth())
+	}
+
+	buf.deliver(block0)
+	if got := []uint64{0}; len(delivered) != len(got) || delivered[0] != got[0] {
+		t.Fatalf("delivered = %v, want %v", delivered, got)
+	}
+
+	// Delivering block 1 should release both it and the already-queued block 2.
+	buf.deliver(block1)
+	want := []uint64{0, 1, 2}
+	if len(delivered) != len(want) {
+		t.Fatalf("delivered = %v, want %v", delivered, want)
+	}
+	for i, n := range want {
+		if delivered[i] != n {
+			t.Fatalf("delivered = %v, want %v", delivered, want)
+		}
+	}
+	if buf.queueDepth() != 0 {
+		t.Fatalf("expected queueDepth to be 0 once everything is delivered, got %d", buf.queueDepth())
+	}
+}
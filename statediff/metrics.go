@@ -0,0 +1,48 @@
+// Copyright 2019 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package statediff
+
+import "github.com/ethereum/go-ethereum/metrics"
+
+// Metrics instrumenting the statediff worker pool, registered against the global go-ethereum
+// metrics registry so they're picked up by whatever the node already exports them through
+// (the debug_metrics RPC namespace, InfluxDB reporter, etc.)
+var (
+	metricsBlocksProcessed    = metrics.NewRegisteredCounter("statediff/blocks/processed", nil)
+	metricsDroppedSubscribers = metrics.NewRegisteredCounter("statediff/subscribers/dropped", nil)
+	metricsQueueDepth         = metrics.NewRegisteredGauge("statediff/queue/depth", nil)
+	metricsBuildLatency       = metrics.NewRegisteredTimer("statediff/build/latency", nil)
+)
+
+// MetricsSnapshot is a point-in-time read of the statediff service's processing metrics, returned
+// by the statediff_metrics RPC method
+type MetricsSnapshot struct {
+	BlocksProcessed    int64
+	DroppedSubscribers int64
+	QueueDepth         int64
+	BuildLatencyMeanMs float64
+}
+
+// currentMetrics reads the live counters/gauges/timer into a MetricsSnapshot
+func currentMetrics() MetricsSnapshot {
+	return MetricsSnapshot{
+		BlocksProcessed:    metricsBlocksProcessed.Count(),
+		DroppedSubscribers: metricsDroppedSubscribers.Count(),
+		QueueDepth:         metricsQueueDepth.Value(),
+		BuildLatencyMeanMs: metricsBuildLatency.Mean() / 1e6,
+	}
+}
@@ -0,0 +1,93 @@
+// Copyright 2019 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package statediff
+
+import (
+	"sort"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/ethereum/go-ethereum/rlp"
+)
+
+// Params specifies the configuration a subscriber can request for how its state diff payloads
+// are built. Subscribers sharing identical Params are grouped together so the builder only has
+// to run once per block for the whole group, see Service.Subscriptions.
+type Params struct {
+	IncludeBlock       bool
+	IncludeReceipts    bool
+	IncludeState       bool
+	IncludeCode        bool
+	WatchedAddresses   []common.Address
+	WatchedStorageKeys map[common.Address][]common.Hash
+}
+
+// rlpParams is the canonical, order-independent encoding of a Params used to derive its hash
+type rlpParams struct {
+	IncludeBlock       bool
+	IncludeReceipts    bool
+	IncludeState       bool
+	IncludeCode        bool
+	WatchedAddresses   []common.Address
+	WatchedStorageKeys []rlpWatchedStorageKeys
+}
+
+type rlpWatchedStorageKeys struct {
+	Address common.Address
+	Keys    []common.Hash
+}
+
+// ParamsHash deterministically hashes a Params struct so that subscribers requesting identical
+// configuration can be grouped and served by a single build pass
+func ParamsHash(params Params) (common.Hash, error) {
+	addresses := make([]common.Address, len(params.WatchedAddresses))
+	copy(addresses, params.WatchedAddresses)
+	sort.Slice(addresses, func(i, j int) bool {
+		return bytes0x(addresses[i]) < bytes0x(addresses[j])
+	})
+
+	keys := make([]rlpWatchedStorageKeys, 0, len(params.WatchedStorageKeys))
+	for addr, slots := range params.WatchedStorageKeys {
+		sorted := make([]common.Hash, len(slots))
+		copy(sorted, slots)
+		sort.Slice(sorted, func(i, j int) bool {
+			return bytes0x(sorted[i]) < bytes0x(sorted[j])
+		})
+		keys = append(keys, rlpWatchedStorageKeys{Address: addr, Keys: sorted})
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		return bytes0x(keys[i].Address) < bytes0x(keys[j].Address)
+	})
+
+	canonical := rlpParams{
+		IncludeBlock:       params.IncludeBlock,
+		IncludeReceipts:    params.IncludeReceipts,
+		IncludeState:       params.IncludeState,
+		IncludeCode:        params.IncludeCode,
+		WatchedAddresses:   addresses,
+		WatchedStorageKeys: keys,
+	}
+	encoded, err := rlp.EncodeToBytes(canonical)
+	if err != nil {
+		return common.Hash{}, err
+	}
+	return crypto.Keccak256Hash(encoded), nil
+}
+
+func bytes0x(b interface{ Bytes() []byte }) string {
+	return string(b.Bytes())
+}
@@ -0,0 +1,127 @@
+// Copyright 2019 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package statediff
+
+import (
+	"database/sql"
+	"fmt"
+
+	"github.com/ethereum/go-ethereum/core/types"
+)
+
+// PostgresWriter persists state diff payloads into a Postgres schema compatible with the
+// vulcanize/ipld-eth indexing tables (header/uncle/transaction/receipt/state/storage cids). Each
+// block is written in its own transaction, so a failure partway through a block never leaves
+// that block's rows half-written.
+type PostgresWriter struct {
+	db *sql.DB
+}
+
+// NewPostgresWriter creates a PostgresWriter over an already-opened *sql.DB
+func NewPostgresWriter(db *sql.DB) *PostgresWriter {
+	return &PostgresWriter{db: db}
+}
+
+// WriteStateDiff inserts the header, uncles, transactions, receipts, and state/storage diff
+// nodes for a single block, committing them together in one transaction
+func (pw *PostgresWriter) WriteStateDiff(block *types.Block, stateDiff StateDiff, payload Payload) error {
+	tx, err := pw.db.Begin()
+	if err != nil {
+		return err
+	}
+	if err := pw.writeBlock(tx, block, stateDiff, payload); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+func (pw *PostgresWriter) writeBlock(tx *sql.Tx, block *types.Block, stateDiff StateDiff, payload Payload) error {
+	if _, err := tx.Exec(
+		`INSERT INTO eth.header_cids (block_number, block_hash) VALUES ($1, $2)
+		 ON CONFLICT (block_hash) DO NOTHING`,
+		block.NumberU64(), block.Hash().Hex(),
+	); err != nil {
+		return fmt.Errorf("writing header_cids for block %d: %w", block.NumberU64(), err)
+	}
+
+	for _, uncle := range block.Uncles() {
+		if _, err := tx.Exec(
+			`INSERT INTO eth.uncle_cids (block_hash, uncle_hash) VALUES ($1, $2)
+			 ON CONFLICT (uncle_hash) DO NOTHING`,
+			block.Hash().Hex(), uncle.Hash().Hex(),
+		); err != nil {
+			return fmt.Errorf("writing uncle_cids for block %d: %w", block.NumberU64(), err)
+		}
+	}
+
+	for _, txn := range block.Transactions() {
+		if _, err := tx.Exec(
+			`INSERT INTO eth.transaction_cids (block_hash, tx_hash) VALUES ($1, $2)
+			 ON CONFLICT (tx_hash) DO NOTHING`,
+			block.Hash().Hex(), txn.Hash().Hex(),
+		); err != nil {
+			return fmt.Errorf("writing transaction_cids for block %d: %w", block.NumberU64(), err)
+		}
+	}
+
+	if _, err := tx.Exec(
+		`INSERT INTO eth.receipt_cids (block_hash, receipts_rlp) VALUES ($1, $2)
+		 ON CONFLICT (block_hash) DO UPDATE SET receipts_rlp = EXCLUDED.receipts_rlp`,
+		block.Hash().Hex(), payload.ReceiptsRlp,
+	); err != nil {
+		return fmt.Errorf("writing receipt_cids for block %d: %w", block.NumberU64(), err)
+	}
+
+	if _, err := tx.Exec(
+		`INSERT INTO eth.state_diff_cids (block_hash, state_diff_rlp) VALUES ($1, $2)
+		 ON CONFLICT (block_hash) DO UPDATE SET state_diff_rlp = EXCLUDED.state_diff_rlp`,
+		block.Hash().Hex(), payload.StateDiffRlp,
+	); err != nil {
+		return fmt.Errorf("writing state_diff_cids for block %d: %w", block.NumberU64(), err)
+	}
+
+	accounts := make([]AccountDiff, 0, len(stateDiff.CreatedAccounts)+len(stateDiff.UpdatedAccounts)+len(stateDiff.DeletedAccounts))
+	accounts = append(accounts, stateDiff.CreatedAccounts...)
+	accounts = append(accounts, stateDiff.UpdatedAccounts...)
+	accounts = append(accounts, stateDiff.DeletedAccounts...)
+	for _, account := range accounts {
+		if _, err := tx.Exec(
+			`INSERT INTO eth.state_cids (block_hash, state_leaf_key, state_val) VALUES ($1, $2, $3)
+			 ON CONFLICT (block_hash, state_leaf_key) DO UPDATE SET state_val = EXCLUDED.state_val`,
+			block.Hash().Hex(), account.Key, account.Value,
+		); err != nil {
+			return fmt.Errorf("writing state_cids for block %d: %w", block.NumberU64(), err)
+		}
+		for _, storage := range account.Storage {
+			if _, err := tx.Exec(
+				`INSERT INTO eth.storage_cids (block_hash, state_leaf_key, storage_leaf_key, storage_val) VALUES ($1, $2, $3, $4)
+				 ON CONFLICT (block_hash, state_leaf_key, storage_leaf_key) DO UPDATE SET storage_val = EXCLUDED.storage_val`,
+				block.Hash().Hex(), account.Key, storage.Key, storage.Value,
+			); err != nil {
+				return fmt.Errorf("writing storage_cids for block %d: %w", block.NumberU64(), err)
+			}
+		}
+	}
+
+	return nil
+}
+
+// Close closes the underlying database connection pool
+func (pw *PostgresWriter) Close() error {
+	return pw.db.Close()
+}
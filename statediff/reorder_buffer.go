@@ -0,0 +1,101 @@
+// Copyright 2019 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package statediff
+
+import (
+	"fmt"
+
+	"github.com/ethereum/go-ethereum/log"
+)
+
+// reorderBuffer buffers completed blockResults until it's that block's turn to be delivered in
+// ascending block-number order, so that Loop's concurrently-processed blocks are still served out
+// in order. It is not safe for concurrent use; Loop drives it from a single goroutine.
+//
+// A chain reorg can replace a block whose number the buffer has already delivered past; that
+// replacement result is delivered immediately, out of band from the ordering, rather than being
+// keyed into pending under a number deliverReady will never look at again. A reorg can also emit
+// more than one result for the same still-pending number (the old and new fork's block at that
+// height); pending queues results per number rather than keeping only the latest, so both are
+// still delivered, in completion order, instead of one silently overwriting the other.
+type reorderBuffer struct {
+	pending       map[uint64][]blockResult
+	nextToDeliver uint64
+	started       bool
+	inFlight      int
+}
+
+// newReorderBuffer creates an empty reorderBuffer
+func newReorderBuffer() *reorderBuffer {
+	return &reorderBuffer{pending: make(map[uint64][]blockResult)}
+}
+
+// dispatch records that blockNumber has been handed off to the worker pool and is now in flight.
+// The first call seeds nextToDeliver, since Loop doesn't know the chain's starting block number
+// until its first chain event arrives.
+func (b *reorderBuffer) dispatch(blockNumber uint64) {
+	if !b.started {
+		b.nextToDeliver = blockNumber
+		b.started = true
+	}
+	b.inFlight++
+}
+
+// deliver handles a finished blockResult, delivering it immediately if it's a reorg replacement
+// for an already-delivered block number, or else queueing it and delivering everything now ready
+// in order
+func (b *reorderBuffer) deliver(res blockResult) {
+	if res.blockNumber < b.nextToDeliver {
+		log.Warn("Delivering out-of-order statediff for reorged block", "number", res.blockNumber, "nextToDeliver", b.nextToDeliver)
+		b.deliverOne(res)
+		return
+	}
+	b.pending[res.blockNumber] = append(b.pending[res.blockNumber], res)
+	b.deliverReady()
+}
+
+// deliverReady delivers every queued result starting from nextToDeliver for as long as there's no
+// gap, advancing nextToDeliver past each one
+func (b *reorderBuffer) deliverReady() {
+	for {
+		queue, ok := b.pending[b.nextToDeliver]
+		if !ok {
+			break
+		}
+		delete(b.pending, b.nextToDeliver)
+		for _, res := range queue {
+			b.deliverOne(res)
+		}
+		b.nextToDeliver++
+	}
+}
+
+// deliverOne runs a single result's deliver func (or logs its build error) and marks it no longer
+// in flight
+func (b *reorderBuffer) deliverOne(res blockResult) {
+	if res.err != nil {
+		log.Error(fmt.Sprintf("Error building statediff for block %d; error: ", res.blockNumber) + res.err.Error())
+	} else if res.deliver != nil {
+		res.deliver()
+	}
+	b.inFlight--
+}
+
+// queueDepth returns the number of blocks currently dispatched but not yet delivered
+func (b *reorderBuffer) queueDepth() int {
+	return b.inFlight
+}
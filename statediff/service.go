@@ -22,9 +22,12 @@ import (
 	"reflect"
 	"sync"
 	"sync/atomic"
+	"time"
 
 	"github.com/ethereum/go-ethereum/common"
 	"github.com/ethereum/go-ethereum/core"
+	"github.com/ethereum/go-ethereum/core/state"
+	"github.com/ethereum/go-ethereum/core/state/snapshot"
 	"github.com/ethereum/go-ethereum/core/types"
 	"github.com/ethereum/go-ethereum/ethdb"
 	"github.com/ethereum/go-ethereum/event"
@@ -33,15 +36,26 @@ import (
 	"github.com/ethereum/go-ethereum/p2p"
 	"github.com/ethereum/go-ethereum/rlp"
 	"github.com/ethereum/go-ethereum/rpc"
+	"github.com/ethereum/go-ethereum/statediff/adapt"
 )
 
 const chainEventChanSize = 20000
 
+const (
+	// DefaultWorkers is the Config.Workers used when it is left unset
+	DefaultWorkers = 4
+	// DefaultMaxQueuedBlocks is the Config.MaxQueuedBlocks used when it is left unset
+	DefaultMaxQueuedBlocks = 32
+)
+
 type blockChain interface {
 	SubscribeChainEvent(ch chan<- core.ChainEvent) event.Subscription
 	GetBlockByHash(hash common.Hash) *types.Block
+	GetBlockByNumber(number uint64) *types.Block
+	CurrentBlock() *types.Block
 	AddToStateDiffProcessedCollection(hash common.Hash)
 	GetReceiptsByHash(hash common.Hash) types.Receipts
+	Snapshots() *snapshot.Tree
 }
 
 // IService is the state-diffing service interface
@@ -50,10 +64,22 @@ type IService interface {
 	node.Service
 	// Main event loop for processing state diffs
 	Loop(chainEventCh chan core.ChainEvent)
-	// Method to subscribe to receive state diff processing output
-	Subscribe(id rpc.ID, sub chan<- Payload, quitChan chan<- bool)
+	// Method to subscribe to receive state diff processing output. resumeFrom is the highest
+	// block number the caller already has (e.g. from a prior connection to this subscription);
+	// if non-zero, the gap between it and the current chain head is backfilled concurrently with
+	// the live blocks the subscription receives from Loop.
+	Subscribe(id rpc.ID, params Params, sub chan<- Payload, quitChan chan<- bool, resumeFrom uint64)
 	// Method to unsubscribe from state diff processing
 	Unsubscribe(id rpc.ID) error
+	// Method to stream state diffs for a fixed historical block range
+	StreamRange(startBlock, endBlock uint64, params Params, sink chan<- Payload, quitChan chan bool) error
+	// Methods to manage the persisted set of watched addresses that, once non-empty, narrows
+	// every state diff Loop builds down to just those accounts (StreamRange and the backfill of a
+	// resuming subscriber build from the caller's own Params, without the watch list)
+	WatchAddresses(addresses []common.Address) error
+	UnwatchAddresses(addresses []common.Address) error
+	SetWatchedAddresses(addresses []common.Address) error
+	ClearWatchedAddresses() error
 }
 
 // Service is the underlying struct for the state diffing service
@@ -61,30 +87,74 @@ type Service struct {
 	// Used to sync access to the Subscriptions
 	sync.Mutex
 	// Used to build the state diff objects
-	Builder Builder
+	Builder StateDiffBuilder
 	// Used to subscribe to chain events (blocks)
 	BlockChain blockChain
 	// Used to signal shutdown of the service
 	QuitChan chan bool
-	// A mapping of rpc.IDs to their subscription channels
-	Subscriptions map[rpc.ID]Subscription
+	// Subscriptions, grouped by a hash of their Params so that subscribers asking for
+	// identical configuration share a single build pass per block
+	Subscriptions map[common.Hash]map[rpc.ID]Subscription
 	// Cache the last block so that we can avoid having to lookup the next block's parent
 	lastBlock *types.Block
-	// Whether or not the block data is streamed alongside the state diff data in the subscription payload
-	StreamBlock bool
 	// Whether or not we have any subscribers; only if we do, do we processes state diffs
 	subscribers int32
+	// Used to walk and build state diffs for historical block ranges, outside of Loop
+	BackFill *BackFillService
+	// Durable sinks payloads are written to, in addition to (or instead of) live RPC subscribers
+	Writers []Writer
+	// Number of concurrent workers Loop uses to build state diffs
+	workers int
+	// Upper bound on the number of blocks in flight (built or awaiting in-order delivery) at once
+	maxQueuedBlocks int
+	// Used to persist the watched address set across restarts
+	db ethdb.Database
+	// Used to sync access to watchedAddrs
+	watchMu sync.Mutex
+	// The persisted set of accounts to restrict every state diff to, once non-empty; managed via
+	// WatchAddresses/UnwatchAddresses/SetWatchedAddresses/ClearWatchedAddresses
+	watchedAddrs map[common.Address]bool
 }
 
 // NewStateDiffService creates a new statediff.Service
 func NewStateDiffService(db ethdb.Database, blockChain *core.BlockChain, config Config) (*Service, error) {
+	var view adapt.StateView = adapt.NewTrieView(state.NewDatabase(db))
+	if snaps := blockChain.Snapshots(); snaps != nil {
+		view = adapt.NewSnapshotFallbackView(view, snaps)
+	}
+	builder := NewBuilder(view)
+	writers, err := writersFor(config)
+	if err != nil {
+		return nil, err
+	}
+	workers := config.Workers
+	if workers < 1 {
+		workers = DefaultWorkers
+	}
+	maxQueuedBlocks := config.MaxQueuedBlocks
+	if maxQueuedBlocks < 1 {
+		maxQueuedBlocks = DefaultMaxQueuedBlocks
+	}
+	initialWatched, err := loadWatchedAddresses(db)
+	if err != nil {
+		return nil, err
+	}
+	watchedAddrs := make(map[common.Address]bool, len(initialWatched))
+	for _, addr := range initialWatched {
+		watchedAddrs[addr] = true
+	}
 	return &Service{
-		Mutex:         sync.Mutex{},
-		BlockChain:    blockChain,
-		Builder:       NewBuilder(db, blockChain, config),
-		QuitChan:      make(chan bool),
-		Subscriptions: make(map[rpc.ID]Subscription),
-		StreamBlock:   config.StreamBlock,
+		Mutex:           sync.Mutex{},
+		BlockChain:      blockChain,
+		Builder:         builder,
+		QuitChan:        make(chan bool),
+		Subscriptions:   make(map[common.Hash]map[rpc.ID]Subscription),
+		BackFill:        NewBackFillService(blockChain, builder, config.BackFill),
+		Writers:         writers,
+		workers:         workers,
+		maxQueuedBlocks: maxQueuedBlocks,
+		db:              db,
+		watchedAddrs:    watchedAddrs,
 	}, nil
 }
 
@@ -105,19 +175,53 @@ func (sds *Service) APIs() []rpc.API {
 	}
 }
 
-// Loop is the main processing method
+// blockJob is a unit of work dispatched to Loop's worker pool: build every subscriber-group and
+// writer payload for a single block
+type blockJob struct {
+	currentBlock *types.Block
+	parentBlock  *types.Block
+}
+
+// blockResult is a completed blockJob, buffered in Loop's reorder buffer until it's that block's
+// turn to be delivered in ascending block-number order
+type blockResult struct {
+	blockNumber uint64
+	deliver     func()
+	err         error
+}
+
+// Loop is the main processing method. It dispatches incoming chain events across a pool of
+// workers so that the CPU-heavy work of diffing multiple blocks' tries can proceed concurrently,
+// then delivers the finished payloads back out to subscribers and writers strictly in ascending
+// block-number order via a reorderBuffer. Once maxQueuedBlocks blocks are in flight (dispatched
+// but not yet delivered), Loop stops reading chainEventCh until a delivery frees up room, rather
+// than dropping events. A subscriber whose channel can't take a payload at delivery time is
+// dropped by send and does not hold up delivery.
 func (sds *Service) Loop(chainEventCh chan core.ChainEvent) {
 	chainEventSub := sds.BlockChain.SubscribeChainEvent(chainEventCh)
 	defer chainEventSub.Unsubscribe()
 	errCh := chainEventSub.Err()
+
+	jobs := make(chan blockJob, sds.workers)
+	results := make(chan blockResult, sds.maxQueuedBlocks)
+	for i := 0; i < sds.workers; i++ {
+		go sds.worker(jobs, results)
+	}
+	defer close(jobs)
+
+	buf := newReorderBuffer()
+
+	// throttled is chainEventCh once the reorder buffer is full, and nil (so the select case
+	// never fires) while we're waiting for deliveries to catch up
+	throttled := chainEventCh
 	for {
 		select {
 		//Notify chain event channel of events
-		case chainEvent := <-chainEventCh:
+		case chainEvent := <-throttled:
 			log.Debug("Event received from chainEventCh", "event", chainEvent)
-			// if we don't have any subscribers, do not process a statediff
-			if atomic.LoadInt32(&sds.subscribers) == 0 {
-				log.Debug("Currently no subscribers to the statediffing service; processing is halted")
+			// if we don't have any subscribers and no writers to persist to, do not process a statediff
+			if atomic.LoadInt32(&sds.subscribers) == 0 && len(sds.Writers) == 0 {
+				log.Debug("Currently no subscribers or writers for the statediffing service; processing is halted")
 				continue
 			}
 			currentBlock := chainEvent.Block
@@ -133,8 +237,17 @@ func (sds *Service) Loop(chainEventCh chan core.ChainEvent) {
 				log.Error(fmt.Sprintf("Parent block is nil, skipping this block (%d)", currentBlock.Number()))
 				continue
 			}
-			if err := sds.processStateDiff(currentBlock, parentBlock); err != nil {
-				log.Error(fmt.Sprintf("Error building statediff for block %d; error: ", currentBlock.Number()) + err.Error())
+			buf.dispatch(currentBlock.NumberU64())
+			jobs <- blockJob{currentBlock: currentBlock, parentBlock: parentBlock}
+			metricsQueueDepth.Update(int64(buf.queueDepth()))
+			if buf.queueDepth() >= sds.maxQueuedBlocks {
+				throttled = nil
+			}
+		case res := <-results:
+			buf.deliver(res)
+			metricsQueueDepth.Update(int64(buf.queueDepth()))
+			if buf.queueDepth() < sds.maxQueuedBlocks {
+				throttled = chainEventCh
 			}
 		case err := <-errCh:
 			log.Warn("Error from chain event subscription, breaking loop", "error", err)
@@ -148,47 +261,135 @@ func (sds *Service) Loop(chainEventCh chan core.ChainEvent) {
 	}
 }
 
-// processStateDiff method builds the state diff payload from the current and parent block before sending it to listening subscriptions
-func (sds *Service) processStateDiff(currentBlock, parentBlock *types.Block) error {
-	stateDiff, err := sds.Builder.BuildStateDiff(parentBlock.Root(), currentBlock.Root(), currentBlock.Number(), currentBlock.Hash())
+// worker builds the payloads for each blockJob it receives and reports the result back, leaving
+// in-order delivery to Loop's reorder buffer
+func (sds *Service) worker(jobs <-chan blockJob, results chan<- blockResult) {
+	for job := range jobs {
+		results <- sds.processBlock(job)
+	}
+}
+
+// processBlock builds the state diff payload once per distinct group of subscription Params, plus
+// once more with the canonical unfiltered Params for any configured Writers, and returns a
+// blockResult whose deliver func fans each payload out. The actual sends happen later, from
+// Loop's single delivery path, so that concurrently-processed blocks are still served in order.
+func (sds *Service) processBlock(job blockJob) blockResult {
+	start := time.Now()
+	currentBlock, parentBlock := job.currentBlock, job.parentBlock
+
+	sds.Lock()
+	groups := make(map[common.Hash]Params, len(sds.Subscriptions))
+	for hash, subs := range sds.Subscriptions {
+		for _, sub := range subs {
+			groups[hash] = sub.Params
+			break
+		}
+	}
+	hasWriters := len(sds.Writers) > 0
+	sds.Unlock()
+
+	type groupPayload struct {
+		hash    common.Hash
+		payload Payload
+		isEmpty bool
+	}
+	groupPayloads := make([]groupPayload, 0, len(groups))
+	for hash, params := range groups {
+		_, payload, err := sds.build(params, currentBlock, parentBlock)
+		if err != nil {
+			return blockResult{blockNumber: currentBlock.NumberU64(), err: err}
+		}
+		isEmpty, err := isEmptyPayload(payload, params, currentBlock)
+		if err != nil {
+			log.Warn("Error checking if payload is empty")
+		}
+		groupPayloads = append(groupPayloads, groupPayload{hash: hash, payload: payload, isEmpty: isEmpty})
+	}
+
+	var writeStateDiff StateDiff
+	var writePayload Payload
+	if hasWriters {
+		var err error
+		writeStateDiff, writePayload, err = sds.build(writerParams, currentBlock, parentBlock)
+		if err != nil {
+			return blockResult{blockNumber: currentBlock.NumberU64(), err: err}
+		}
+	}
+
+	metricsBuildLatency.UpdateSince(start)
+
+	return blockResult{
+		blockNumber: currentBlock.NumberU64(),
+		deliver: func() {
+			for _, gp := range groupPayloads {
+				if !gp.isEmpty {
+					sds.send(gp.hash, gp.payload)
+				}
+			}
+			if hasWriters {
+				for _, writer := range sds.Writers {
+					if err := writer.WriteStateDiff(currentBlock, writeStateDiff, writePayload); err != nil {
+						log.Error(fmt.Sprintf("Error writing statediff for block %d; error: ", currentBlock.Number()) + err.Error())
+					}
+				}
+			}
+			metricsBlocksProcessed.Inc(1)
+		},
+	}
+}
+
+// build constructs the StateDiff and its encoded Payload for currentBlock according to params. If
+// the service has a non-empty persisted watch list, it overrides params.WatchedAddresses so that
+// every diff - regardless of what any individual subscriber or writer asked for - is narrowed
+// down to just the watched accounts.
+func (sds *Service) build(params Params, currentBlock, parentBlock *types.Block) (StateDiff, Payload, error) {
+	if watched := sds.watchedAddresses(); len(watched) > 0 {
+		params.WatchedAddresses = watched
+	}
+	stateDiff, err := sds.Builder.BuildStateDiff(parentBlock.Root(), currentBlock.Root(), currentBlock.Number(), currentBlock.Hash(), params)
 	if err != nil {
-		return err
+		return StateDiff{}, Payload{}, err
 	}
 	stateDiffRlp, err := rlp.EncodeToBytes(stateDiff)
 	if err != nil {
-		return err
+		return StateDiff{}, Payload{}, err
 	}
 	payload := Payload{
 		StateDiffRlp: stateDiffRlp,
 	}
-	if sds.StreamBlock {
+	if params.IncludeBlock {
 		blockBuff := new(bytes.Buffer)
 		if err = currentBlock.EncodeRLP(blockBuff); err != nil {
-			return err
+			return StateDiff{}, Payload{}, err
 		}
 		payload.BlockRlp = blockBuff.Bytes()
+	}
+	if params.IncludeReceipts {
 		receiptBuff := new(bytes.Buffer)
 		receipts := sds.BlockChain.GetReceiptsByHash(currentBlock.Hash())
 		if err = rlp.Encode(receiptBuff, receipts); err != nil {
-			return err
+			return StateDiff{}, Payload{}, err
 		}
 		payload.ReceiptsRlp = receiptBuff.Bytes()
 	}
+	return stateDiff, payload, nil
+}
 
-	isEmpty, err := isEmptyPayload(payload, currentBlock)
-	if err != nil {
-		log.Warn("Error checking if payload is empty")
+// isEmptyPayload reports whether payload has nothing in it worth delivering to a subscriber that
+// asked for params. A bare, unchanged state diff only makes the payload empty when state is the
+// only thing params asked for; a headers/receipts-only subscriber's payload is never empty just
+// because nothing in state changed, since it didn't ask for state in the first place.
+func isEmptyPayload(payload Payload, params Params, block *types.Block) (bool, error) {
+	if params.IncludeBlock && len(payload.BlockRlp) > 0 {
+		return false, nil
 	}
-
-	//Send a payload to subscribers only if isn't empty
-	if !isEmpty {
-		sds.send(payload)
+	if params.IncludeReceipts && len(payload.ReceiptsRlp) > 0 {
+		return false, nil
+	}
+	if !params.IncludeState {
+		return true, nil
 	}
 
-	return nil
-}
-
-func isEmptyPayload(payload Payload, block *types.Block) (bool, error) {
 	emptyStateDiffRlp, err := getEmptyStateDiffRlpForBlock(block)
 	if err != nil {
 		return false, err
@@ -206,38 +407,88 @@ func getEmptyStateDiffRlpForBlock(block *types.Block) ([]byte, error) {
 	return rlp.EncodeToBytes(stateDiffWithoutUpdatedAccounts)
 }
 
-// Subscribe is used by the API to subscribe to the service loop
-func (sds *Service) Subscribe(id rpc.ID, sub chan<- Payload, quitChan chan<- bool) {
+// Subscribe is used by the API to subscribe to the service loop. Subscribers with identical
+// params are grouped together under a hash of those params, so the builder only runs once per
+// group per block. resumeFrom is the highest block number the caller already received from this
+// same subscription on a prior connection; since each connection gets a brand-new rpc.ID, the
+// caller, not the service, is the only one who actually knows this. If non-zero, the range
+// between it and the current chain head is backfilled in a separate goroutine. The subscription
+// is registered for live delivery from Loop straight away, so backfilled and live payloads can
+// arrive interleaved, and backfilled payloads are not necessarily in ascending block order.
+func (sds *Service) Subscribe(id rpc.ID, params Params, sub chan<- Payload, quitChan chan<- bool, resumeFrom uint64) {
 	log.Info("Subscribing to the statediff service")
 	if atomic.CompareAndSwapInt32(&sds.subscribers, 0, 1) {
 		log.Info("State diffing subscription received; beginning statediff processing")
 	}
+	hash, err := ParamsHash(params)
+	if err != nil {
+		log.Error(fmt.Sprintf("Unable to hash params for subscription %s; error: ", id) + err.Error())
+		return
+	}
 	sds.Lock()
-	sds.Subscriptions[id] = Subscription{
+	if sds.Subscriptions[hash] == nil {
+		sds.Subscriptions[hash] = make(map[rpc.ID]Subscription)
+	}
+	sds.Subscriptions[hash][id] = Subscription{
 		PayloadChan: sub,
 		QuitChan:    quitChan,
+		Params:      params,
 	}
 	sds.Unlock()
+
+	if resumeFrom > 0 {
+		go sds.backFillGap(id, params, resumeFrom, sub, quitChan)
+	}
+}
+
+// backFillGap walks the range (fromBlock, chain head] using the BackFillService and pushes the
+// results directly to the given subscriber, so a reconnecting subscriber that passes in the last
+// block number it saw doesn't silently miss the blocks produced while it was disconnected
+func (sds *Service) backFillGap(id rpc.ID, params Params, fromBlock uint64, sub chan<- Payload, quitChan chan<- bool) {
+	head := sds.BlockChain.CurrentBlock()
+	if head == nil || head.NumberU64() <= fromBlock {
+		return
+	}
+	log.Info("Detected gap for reconnecting statediff subscriber; backfilling", "id", id, "from", fromBlock+1, "to", head.NumberU64())
+	internalQuit := make(chan bool)
+	if err := sds.BackFill.BackFill(fromBlock+1, head.NumberU64(), params, sub, internalQuit); err != nil {
+		log.Error(fmt.Sprintf("Error backfilling gap for subscription %s; error: ", id) + err.Error())
+	}
 }
 
 // Unsubscribe is used to unsubscribe from the service loop
 func (sds *Service) Unsubscribe(id rpc.ID) error {
 	log.Info("Unsubscribing from the statediff service")
 	sds.Lock()
-	_, ok := sds.Subscriptions[id]
-	if !ok {
+	defer sds.Unlock()
+	found := false
+	for hash, subs := range sds.Subscriptions {
+		if _, ok := subs[id]; ok {
+			delete(subs, id)
+			if len(subs) == 0 {
+				delete(sds.Subscriptions, hash)
+			}
+			found = true
+			break
+		}
+	}
+	if !found {
 		return fmt.Errorf("cannot unsubscribe; subscription for id %s does not exist", id)
 	}
-	delete(sds.Subscriptions, id)
 	if len(sds.Subscriptions) == 0 {
 		if atomic.CompareAndSwapInt32(&sds.subscribers, 1, 0) {
 			log.Info("No more subscriptions; halting statediff processing")
 		}
 	}
-	sds.Unlock()
 	return nil
 }
 
+// StreamRange builds and streams the state diffs for every block in [startBlock, endBlock] to
+// sink, via the BackFillService rather than the live Loop chain event path
+func (sds *Service) StreamRange(startBlock, endBlock uint64, params Params, sink chan<- Payload, quitChan chan bool) error {
+	return sds.BackFill.BackFill(startBlock, endBlock, params, sink, quitChan)
+}
+
 // Start is used to begin the service
 func (sds *Service) Start(*p2p.Server) error {
 	log.Info("Starting statediff service")
@@ -252,18 +503,25 @@ func (sds *Service) Start(*p2p.Server) error {
 func (sds *Service) Stop() error {
 	log.Info("Stopping statediff service")
 	close(sds.QuitChan)
+	for _, writer := range sds.Writers {
+		if err := writer.Close(); err != nil {
+			log.Error("Error closing statediff writer", "error", err)
+		}
+	}
 	return nil
 }
 
-// send is used to fan out and serve the payloads to all subscriptions
-func (sds *Service) send(payload Payload) {
+// send is used to fan out and serve the payload to every subscription in the given params group
+func (sds *Service) send(hash common.Hash, payload Payload) {
 	sds.Lock()
-	for id, sub := range sds.Subscriptions {
+	subs := sds.Subscriptions[hash]
+	for id, sub := range subs {
 		select {
 		case sub.PayloadChan <- payload:
 			log.Info(fmt.Sprintf("sending state diff payload to subscription %s", id))
 		default:
 			log.Info(fmt.Sprintf("unable to send payload to subscription %s; channel has no receiver", id))
+			metricsDroppedSubscribers.Inc(1)
 			// in this case, try to close the bad subscription and remove it
 			select {
 			case sub.QuitChan <- true:
@@ -271,9 +529,12 @@ func (sds *Service) send(payload Payload) {
 			default:
 				log.Info(fmt.Sprintf("unable to close subscription %s; channel has no receiver", id))
 			}
-			delete(sds.Subscriptions, id)
+			delete(subs, id)
 		}
 	}
+	if len(subs) == 0 {
+		delete(sds.Subscriptions, hash)
+	}
 	// If after removing all bad subscriptions we have none left, halt processing
 	if len(sds.Subscriptions) == 0 {
 		if atomic.CompareAndSwapInt32(&sds.subscribers, 1, 0) {
@@ -286,14 +547,17 @@ func (sds *Service) send(payload Payload) {
 // close is used to close all listening subscriptions
 func (sds *Service) close() {
 	sds.Lock()
-	for id, sub := range sds.Subscriptions {
-		select {
-		case sub.QuitChan <- true:
-			log.Info(fmt.Sprintf("closing subscription %s", id))
-		default:
-			log.Info(fmt.Sprintf("unable to close subscription %s; channel has no receiver", id))
+	for hash, subs := range sds.Subscriptions {
+		for id, sub := range subs {
+			select {
+			case sub.QuitChan <- true:
+				log.Info(fmt.Sprintf("closing subscription %s", id))
+			default:
+				log.Info(fmt.Sprintf("unable to close subscription %s; channel has no receiver", id))
+			}
+			delete(subs, id)
 		}
-		delete(sds.Subscriptions, id)
+		delete(sds.Subscriptions, hash)
 	}
 	sds.Unlock()
 }
@@ -0,0 +1,71 @@
+// Copyright 2019 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package statediff
+
+import (
+	"math/big"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/core/types"
+)
+
+// TestIsEmptyPayloadHeadersOnly guards against a headers/receipts-only subscriber (IncludeState
+// false) never receiving anything: its payload is "empty" by the bare state-diff sentinel even
+// though it carries the block/receipts RLP it actually asked for.
+func TestIsEmptyPayloadHeadersOnly(t *testing.T) {
+	block := types.NewBlockWithHeader(&types.Header{Number: big.NewInt(1)})
+	params := Params{IncludeBlock: true, IncludeReceipts: true, IncludeState: false}
+
+	emptyStateDiffRlp, err := getEmptyStateDiffRlpForBlock(block)
+	if err != nil {
+		t.Fatal(err)
+	}
+	payload := Payload{
+		BlockRlp:     []byte{0x01},
+		ReceiptsRlp:  []byte{0x02},
+		StateDiffRlp: emptyStateDiffRlp,
+	}
+
+	isEmpty, err := isEmptyPayload(payload, params, block)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if isEmpty {
+		t.Fatal("headers-only payload with a populated BlockRlp/ReceiptsRlp must not be reported empty")
+	}
+}
+
+// TestIsEmptyPayloadUnchangedState guards the complementary case: a state-only subscriber whose
+// state diff didn't change anything should still be treated as empty.
+func TestIsEmptyPayloadUnchangedState(t *testing.T) {
+	block := types.NewBlockWithHeader(&types.Header{Number: big.NewInt(1)})
+	params := Params{IncludeState: true}
+
+	emptyStateDiffRlp, err := getEmptyStateDiffRlpForBlock(block)
+	if err != nil {
+		t.Fatal(err)
+	}
+	payload := Payload{StateDiffRlp: emptyStateDiffRlp}
+
+	isEmpty, err := isEmptyPayload(payload, params, block)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !isEmpty {
+		t.Fatal("an unchanged state diff for a state-only subscriber should be reported empty")
+	}
+}
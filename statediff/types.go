@@ -0,0 +1,50 @@
+// Copyright 2019 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package statediff
+
+import (
+	"math/big"
+
+	"github.com/ethereum/go-ethereum/common"
+)
+
+// StateDiff is the final output structure from the builder
+type StateDiff struct {
+	BlockNumber     *big.Int      `json:"blockNumber"     gencodec:"required"`
+	BlockHash       common.Hash   `json:"blockHash"        gencodec:"required"`
+	CreatedAccounts []AccountDiff `json:"createdAccounts"  gencodec:"required"`
+	DeletedAccounts []AccountDiff `json:"deletedAccounts"  gencodec:"required"`
+	UpdatedAccounts []AccountDiff `json:"updatedAccounts"  gencodec:"required"`
+}
+
+// AccountDiff holds the data for a single changed account leaf node
+type AccountDiff struct {
+	Leaf    bool          `json:"leaf"    gencodec:"required"`
+	Key     []byte        `json:"key"     gencodec:"required"`
+	Value   []byte        `json:"value"   gencodec:"required"`
+	Storage []StorageDiff `json:"storage" gencodec:"required"`
+	// Code is the account's contract code, populated only when the requesting Params has
+	// IncludeCode set and the account actually has code (i.e. isn't an EOA)
+	Code []byte `json:"code,omitempty"`
+}
+
+// StorageDiff holds the data for a single changed storage leaf node
+type StorageDiff struct {
+	Leaf  bool   `json:"leaf"  gencodec:"required"`
+	Key   []byte `json:"key"   gencodec:"required"`
+	Value []byte `json:"value" gencodec:"required"`
+}
@@ -0,0 +1,118 @@
+// Copyright 2019 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package statediff
+
+import (
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/ethdb"
+	"github.com/ethereum/go-ethereum/rlp"
+)
+
+// watchedAddressesKey is the ethdb key the persisted watch list is stored under, so an operator's
+// watch list survives a node restart
+var watchedAddressesKey = []byte("statediff-watched-addresses")
+
+// WatchAddresses adds the given addresses to the service's persisted watch list. Once the list is
+// non-empty, every state diff Loop builds - for subscribers and writers alike - is narrowed down
+// to just the watched accounts, which lets an operator run a "watch mode" that stays cheap at
+// full mainnet load by only diffing a handful of contracts. Historical ranges served by
+// StreamRange and the gap backfilled for a resuming subscriber are built from the caller's own
+// Params, without the watch list.
+func (sds *Service) WatchAddresses(addresses []common.Address) error {
+	sds.watchMu.Lock()
+	defer sds.watchMu.Unlock()
+	for _, addr := range addresses {
+		sds.watchedAddrs[addr] = true
+	}
+	return persistWatchedAddresses(sds.db, sds.watchedAddressesLocked())
+}
+
+// UnwatchAddresses removes the given addresses from the service's persisted watch list
+func (sds *Service) UnwatchAddresses(addresses []common.Address) error {
+	sds.watchMu.Lock()
+	defer sds.watchMu.Unlock()
+	for _, addr := range addresses {
+		delete(sds.watchedAddrs, addr)
+	}
+	return persistWatchedAddresses(sds.db, sds.watchedAddressesLocked())
+}
+
+// SetWatchedAddresses replaces the service's persisted watch list wholesale
+func (sds *Service) SetWatchedAddresses(addresses []common.Address) error {
+	sds.watchMu.Lock()
+	defer sds.watchMu.Unlock()
+	sds.watchedAddrs = make(map[common.Address]bool, len(addresses))
+	for _, addr := range addresses {
+		sds.watchedAddrs[addr] = true
+	}
+	return persistWatchedAddresses(sds.db, sds.watchedAddressesLocked())
+}
+
+// ClearWatchedAddresses empties the service's persisted watch list, returning to diffing every
+// account
+func (sds *Service) ClearWatchedAddresses() error {
+	sds.watchMu.Lock()
+	defer sds.watchMu.Unlock()
+	sds.watchedAddrs = make(map[common.Address]bool)
+	return persistWatchedAddresses(sds.db, nil)
+}
+
+// watchedAddresses returns a snapshot of the currently-watched addresses
+func (sds *Service) watchedAddresses() []common.Address {
+	sds.watchMu.Lock()
+	defer sds.watchMu.Unlock()
+	return sds.watchedAddressesLocked()
+}
+
+// watchedAddressesLocked returns a snapshot of the watch list; callers must hold sds.watchMu
+func (sds *Service) watchedAddressesLocked() []common.Address {
+	addresses := make([]common.Address, 0, len(sds.watchedAddrs))
+	for addr := range sds.watchedAddrs {
+		addresses = append(addresses, addr)
+	}
+	return addresses
+}
+
+// loadWatchedAddresses reads the persisted watch list out of db, returning a nil, nil result if
+// nothing has been persisted yet
+func loadWatchedAddresses(db ethdb.Database) ([]common.Address, error) {
+	has, err := db.Has(watchedAddressesKey)
+	if err != nil {
+		return nil, err
+	}
+	if !has {
+		return nil, nil
+	}
+	raw, err := db.Get(watchedAddressesKey)
+	if err != nil {
+		return nil, err
+	}
+	var addresses []common.Address
+	if err := rlp.DecodeBytes(raw, &addresses); err != nil {
+		return nil, err
+	}
+	return addresses, nil
+}
+
+// persistWatchedAddresses writes the watch list to db so it survives a restart
+func persistWatchedAddresses(db ethdb.Database, addresses []common.Address) error {
+	raw, err := rlp.EncodeToBytes(addresses)
+	if err != nil {
+		return err
+	}
+	return db.Put(watchedAddressesKey, raw)
+}
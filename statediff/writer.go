@@ -0,0 +1,76 @@
+// Copyright 2019 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package statediff
+
+import (
+	"errors"
+
+	"github.com/ethereum/go-ethereum/core/types"
+)
+
+var errNoPostgresDB = errors.New("statediff: postgres write mode requires a Config.PostgresDB")
+
+// WriteMode selects which durable sink(s), if any, a statediff.Service persists payloads to, in
+// addition to (or instead of) serving them to live RPC subscribers
+type WriteMode string
+
+const (
+	// WriteModeRPC only serves payloads to live RPC subscribers; this is the historical behavior
+	WriteModeRPC WriteMode = "rpc"
+	// WriteModeFile additionally writes payloads to a FileWriter
+	WriteModeFile WriteMode = "file"
+	// WriteModePostgres additionally writes payloads to a PostgresWriter
+	WriteModePostgres WriteMode = "postgres"
+	// WriteModeBoth additionally writes payloads to both a FileWriter and a PostgresWriter
+	WriteModeBoth WriteMode = "both"
+)
+
+// Writer persists a single block's state diff to a durable sink, as an alternative (or addition)
+// to serving it to live RPC subscribers. Each call is expected to commit (or roll back) in full;
+// statediff.Service does not retry a failed write.
+type Writer interface {
+	WriteStateDiff(block *types.Block, stateDiff StateDiff, payload Payload) error
+	Close() error
+}
+
+// writerParams is the canonical, unfiltered Params a Service builds against for its configured
+// Writers, independent of whatever narrower Params any live RPC subscribers have requested
+var writerParams = Params{
+	IncludeBlock:    true,
+	IncludeReceipts: true,
+	IncludeState:    true,
+	IncludeCode:     true,
+}
+
+// writersFor builds the set of Writers a Service should use for the given WriteMode
+func writersFor(config Config) ([]Writer, error) {
+	var writers []Writer
+	if config.WriteMode == WriteModeFile || config.WriteMode == WriteModeBoth {
+		fw, err := NewFileWriter(config.FileWriterDir)
+		if err != nil {
+			return nil, err
+		}
+		writers = append(writers, fw)
+	}
+	if config.WriteMode == WriteModePostgres || config.WriteMode == WriteModeBoth {
+		if config.PostgresDB == nil {
+			return nil, errNoPostgresDB
+		}
+		writers = append(writers, NewPostgresWriter(config.PostgresDB))
+	}
+	return writers, nil
+}